@@ -0,0 +1,225 @@
+// Approval gate for the profiles with require_approval=true (prod).
+// A reviewer approves the exact job that will be submitted, identified by the hash of the rendered job,
+// with cs approve. The approval is stored in consul KV under approvals/<job id>/<job hash> and expires.
+//
+// Approvals are signed with the vault transit key cs-approval. Only reviewers are allowed to sign with it
+// (transit/sign/cs-approval), deployers are only allowed to verify (transit/verify/cs-approval), so a deployer
+// can't make an approval. The approver is the vault identity of the token that signed, and the deployer
+// is refused an approval of their own vault identity.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+
+	consulapi "github.com/hashicorp/consul/api"
+	nomadapi "github.com/hashicorp/nomad/api"
+
+	"./utils"
+)
+
+const (
+	APPROVAL_CONSUL_PATH    = "approvals/"
+	APPROVAL_TRANSIT_SIGN   = "transit/sign/cs-approval"
+	APPROVAL_TRANSIT_VERIFY = "transit/verify/cs-approval"
+	ERR_APPROVAL            = 34
+)
+
+type Approval struct {
+	ID             string    `json:"id"`
+	JobID          string    `json:"job_id"`
+	JobHash        string    `json:"job_hash"`
+	Profile        string    `json:"profile"`
+	Approver       string    `json:"approver"`
+	ApproverEntity string    `json:"approver_entity"`
+	Hostname       string    `json:"hostname"`
+	Comment        string    `json:"comment,omitempty"`
+	Approved       time.Time `json:"approved"`
+	Expires        time.Time `json:"expires"`
+	Signature      string    `json:"signature"`
+}
+
+func approvalKey(job_id string, jobHash string) string {
+	return APPROVAL_CONSUL_PATH + job_id + "/" + jobHash
+}
+
+// The signed fields of the approval, base64 encoded as transit expects its input.
+func (a *Approval) payload() string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Join([]string{a.ID, a.JobID, a.JobHash, a.Profile,
+		a.Approver, a.ApproverEntity, a.Hostname, a.Comment,
+		a.Approved.Format(time.RFC3339), a.Expires.Format(time.RFC3339)}, "|")))
+}
+
+func (a *Approval) sign() (string, error) {
+	vault := utils.GetVaultClient()
+	secret, err := vault.Logical().Write(APPROVAL_TRANSIT_SIGN, map[string]interface{}{"input": a.payload()})
+	if err != nil {
+		return "", err
+	}
+	if secret == nil || secret.Data == nil {
+		return "", fmt.Errorf("no signature from %s", APPROVAL_TRANSIT_SIGN)
+	}
+
+	signature, _ := secret.Data["signature"].(string)
+	if signature == "" {
+		return "", fmt.Errorf("no signature from %s", APPROVAL_TRANSIT_SIGN)
+	}
+
+	return signature, nil
+}
+
+func (a *Approval) verify() error {
+	vault := utils.GetVaultClient()
+	secret, err := vault.Logical().Write(APPROVAL_TRANSIT_VERIFY, map[string]interface{}{"input": a.payload(), "signature": a.Signature})
+	if err != nil {
+		return fmt.Errorf("unable to verify the signature of approval %s: %s", a.ID, err)
+	}
+	if secret == nil || secret.Data == nil {
+		return fmt.Errorf("unable to verify the signature of approval %s: no answer from %s", a.ID, APPROVAL_TRANSIT_VERIFY)
+	}
+	if valid, _ := secret.Data["valid"].(bool); !valid {
+		return fmt.Errorf("approval %s has an invalid signature", a.ID)
+	}
+
+	return nil
+}
+
+// The display name and the entity id of the vault token of the user, the identity approvals are signed and checked with.
+func vaultIdentity() (string, string, error) {
+	vault := utils.GetVaultClient()
+	secret, err := vault.Auth().Token().LookupSelf()
+	if err != nil {
+		return "", "", err
+	}
+	if secret == nil || secret.Data == nil {
+		return "", "", fmt.Errorf("empty token lookup")
+	}
+
+	displayName, _ := secret.Data["display_name"].(string)
+	entityID, _ := secret.Data["entity_id"].(string)
+	if displayName == "" && entityID == "" {
+		return "", "", fmt.Errorf("the vault token has neither a display name nor an entity")
+	}
+
+	return displayName, entityID, nil
+}
+
+func sameVaultIdentity(name string, entityID string, otherName string, otherEntityID string) bool {
+	if entityID != "" && otherEntityID != "" {
+		return entityID == otherEntityID
+	}
+
+	return name == otherName
+}
+
+func approveJob(consulClient *consulapi.Client, job_id string, jobHash string, expiresIn time.Duration, comment string) *Approval {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		fmt.Printf("Unable to create an approval id, Error: %s \n", err)
+		exitWith(ERR_APPROVAL)
+	}
+
+	approver, approverEntity, err := vaultIdentity()
+	if err != nil {
+		fmt.Printf("Unable to look up the vault identity of the approver, Error: %s \n", err)
+		exitWith(ERR_APPROVAL)
+	}
+	_, hostname := currentIdentity()
+	now := time.Now().UTC().Truncate(time.Second)
+	approval := &Approval{
+		ID:             hex.EncodeToString(id),
+		JobID:          job_id,
+		JobHash:        jobHash,
+		Profile:        viper.GetString("active"),
+		Approver:       approver,
+		ApproverEntity: approverEntity,
+		Hostname:       hostname,
+		Comment:        comment,
+		Approved:       now,
+		Expires:        now.Add(expiresIn),
+	}
+	if approval.Signature, err = approval.sign(); err != nil {
+		fmt.Printf("Unable to sign approval of job %s with %s (only reviewers may sign), Error: %s \n", job_id, APPROVAL_TRANSIT_SIGN, err)
+		exitWith(ERR_APPROVAL)
+	}
+
+	value, _ := json.Marshal(approval)
+	if dryRun {
+		printDryRun("would write approval %s to consul key %s: %s \n", approval.ID, approvalKey(job_id, jobHash), value)
+		return approval
+	}
+
+	if _, err := consulClient.KV().Put(&consulapi.KVPair{Key: approvalKey(job_id, jobHash), Value: value}, nil); err != nil {
+		fmt.Printf("Unable to write approval of job %s to consul, Error: %s \n", job_id, err)
+		exitWith(ERR_APPROVAL)
+	}
+
+	return approval
+}
+
+// For profiles that require approval, refuses the job unless a valid approval exists for its rendered job hash.
+func checkJobApproval(consulClient *consulapi.Client, parsedFile *nomadapi.Job) {
+	if !viper.GetBool(viper.GetString("active") + ".require_approval") {
+		return
+	}
+
+	job_id := jobID(parsedFile)
+	jobHash := contentHash(renderNomadJob(parsedFile))
+
+	approval, err := readApproval(consulClient, job_id, jobHash)
+	if err != nil {
+		fmt.Printf("Job %s is not approved for profile %s: %s \n", job_id, viper.GetString("active"), err)
+		fmt.Printf("To approve it, a reviewer runs: cs approve %s %s \n", job_id, jobHash)
+		exitWith(ERR_APPROVAL)
+	}
+
+	// the reviewer can't be the one who deploys, both are identified by their vault token
+	deployer, deployerEntity, err := vaultIdentity()
+	if err != nil {
+		fmt.Printf("Unable to look up the vault identity of the deployer, Error: %s \n", err)
+		exitWith(ERR_APPROVAL)
+	}
+	if sameVaultIdentity(approval.Approver, approval.ApproverEntity, deployer, deployerEntity) {
+		fmt.Printf("Job %s was approved by %s, who is deploying it. The approval must come from another reviewer. \n", job_id, deployer)
+		exitWith(ERR_APPROVAL)
+	}
+
+	fmt.Printf("Job %s approved by %s (approval %s, expires %s) \n", job_id, approval.Approver, approval.ID,
+		approval.Expires.Local().Format("2006-01-02 15:04"))
+	auditApproval(approval.ID)
+}
+
+func readApproval(consulClient *consulapi.Client, job_id string, jobHash string) (*Approval, error) {
+	kvp, _, err := consulClient.KV().Get(approvalKey(job_id, jobHash), nil)
+	if err != nil {
+		return nil, err
+	}
+	if kvp == nil {
+		return nil, fmt.Errorf("no approval for job hash %s", jobHash)
+	}
+
+	var approval Approval
+	if err := json.Unmarshal(kvp.Value, &approval); err != nil {
+		return nil, fmt.Errorf("malformed approval %s: %s", kvp.Key, err)
+	}
+
+	if err := approval.verify(); err != nil {
+		return nil, err
+	}
+	if approval.JobID != job_id || approval.JobHash != jobHash || approval.Profile != viper.GetString("active") {
+		return nil, fmt.Errorf("approval %s is for job %s hash %s in profile %s", approval.ID, approval.JobID, approval.JobHash, approval.Profile)
+	}
+	if time.Now().After(approval.Expires) {
+		return nil, fmt.Errorf("approval %s by %s expired at %s", approval.ID, approval.Approver, approval.Expires.Local().Format("2006-01-02 15:04"))
+	}
+
+	return &approval, nil
+}
@@ -0,0 +1,317 @@
+// Audit trail of the mutating cs commands (run, run-artifact-id, quota init, cert upload, builder push, ...).
+// Records are stored in consul KV under audit/records/ and/or appended to a local JSON log,
+// depending on the audit_store property ("consul", "file" or "both", the default).
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	consulapi "github.com/hashicorp/consul/api"
+	nomadapi "github.com/hashicorp/nomad/api"
+
+	"./utils"
+)
+
+const (
+	AUDIT_CONSUL_PATH      = "audit/records/"
+	AUDIT_DEFAULT_LOG_FILE = "$HOME/.cs/audit.log"
+	ERR_AUDIT              = 26
+)
+
+type AuditRecord struct {
+	Time       time.Time `json:"time"`
+	User       string    `json:"user"`
+	Hostname   string    `json:"hostname"`
+	Profile    string    `json:"profile"`
+	Env        string    `json:"env"`
+	Command    string    `json:"command"`
+	JobID      string    `json:"job_id,omitempty"`
+	JobSource  string    `json:"job_source,omitempty"`
+	FileHash   string    `json:"file_hash,omitempty"`
+	JobHash    string    `json:"job_hash,omitempty"`
+	Images     []string  `json:"images,omitempty"`
+	BreakGlass string    `json:"break_glass,omitempty"`
+	ApprovalID string    `json:"approval_id,omitempty"`
+	Result     string    `json:"result"`
+	ExitCode   int       `json:"exit_code"`
+}
+
+// The record of the mutating command that is running, written by finishAudit.
+var pendingAudit *AuditRecord
+
+func startAudit(cmd *cobra.Command, args []string) {
+	userName, hostname := currentIdentity()
+
+	pendingAudit = &AuditRecord{
+		Time:     time.Now().UTC(),
+		User:     userName,
+		Hostname: hostname,
+		Profile:  viper.GetString("active"),
+		Env:      utils.GetConfigString("env"),
+		Command:  strings.TrimSpace(cmd.CommandPath() + " " + strings.Join(args, " ")),
+	}
+}
+
+// The OS user and the hostname cs runs as.
+func currentIdentity() (string, string) {
+	userName := ""
+	if currentUser, err := user.Current(); err == nil {
+		userName = currentUser.Username
+	}
+	hostname, _ := os.Hostname()
+
+	return userName, hostname
+}
+
+// Records the profile the command switched to (cs promote deploys into the --to profile).
+func auditProfile() {
+	if pendingAudit == nil {
+		return
+	}
+
+	pendingAudit.Profile = viper.GetString("active")
+	pendingAudit.Env = utils.GetConfigString("env")
+}
+
+func auditJobFile(fileHash string, source string) {
+	if pendingAudit == nil {
+		return
+	}
+
+	pendingAudit.FileHash = fileHash
+	pendingAudit.JobSource = source
+}
+
+func auditJob(parsedFile *nomadapi.Job) {
+	if pendingAudit == nil {
+		return
+	}
+
+	pendingAudit.JobID = jobID(parsedFile)
+	pendingAudit.JobHash = contentHash(renderNomadJob(parsedFile))
+	pendingAudit.Images = make([]string, 0)
+	for _, taskImage := range dockerTaskImages(parsedFile) {
+		pendingAudit.Images = append(pendingAudit.Images, taskImage.Image)
+	}
+}
+
+func auditBreakGlass(freezeName string, reason string) {
+	if pendingAudit == nil {
+		return
+	}
+
+	if pendingAudit.BreakGlass != "" {
+		pendingAudit.BreakGlass += "; "
+	}
+	pendingAudit.BreakGlass += fmt.Sprintf("freeze %s: %s", freezeName, reason)
+}
+
+func auditApproval(approvalID string) {
+	if pendingAudit == nil {
+		return
+	}
+
+	pendingAudit.ApprovalID = approvalID
+}
+
+func contentHash(content []byte) string {
+	sum := sha256.Sum256(content)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// Every exit of cs goes through here, so a command that fails still releases its deploy lock and writes its audit record.
+func exitWith(exitCode int) {
+	releaseDeployLock()
+	finishAudit(exitCode)
+	os.Exit(exitCode)
+}
+
+// Writes the record of the running command with the result given by its exit code.
+func finishAudit(exitCode int) {
+	if pendingAudit == nil {
+		return
+	}
+
+	record := pendingAudit
+	pendingAudit = nil
+
+	// nothing was changed, so there is nothing to audit
+	if dryRun {
+		return
+	}
+
+	record.ExitCode = exitCode
+	if exitCode == EXIT_SUCCESS {
+		record.Result = "success"
+	} else {
+		record.Result = "failed"
+	}
+
+	value, err := json.Marshal(record)
+	if err != nil {
+		fmt.Printf("Unable to write audit record, Error: %s \n", err)
+		return
+	}
+
+	auditStore := auditStore()
+	if auditStore != "file" {
+		key := fmt.Sprintf("%s%d-%s", AUDIT_CONSUL_PATH, record.Time.UnixNano(), record.User)
+		if _, err := utils.GetConsulClient().KV().Put(&consulapi.KVPair{Key: key, Value: value}, nil); err != nil {
+			fmt.Printf("Unable to write audit record to consul, Error: %s \n", err)
+		}
+	}
+	if auditStore != "consul" {
+		appendAuditLog(value)
+	}
+}
+
+func auditStore() string {
+	store := utils.GetConfigString("audit_store")
+	if store == "" {
+		return "both"
+	}
+
+	return store
+}
+
+func auditLogFile() string {
+	logFile := utils.GetConfigString("audit_log_file")
+	if logFile == "" {
+		logFile = AUDIT_DEFAULT_LOG_FILE
+	}
+
+	return os.ExpandEnv(logFile)
+}
+
+func appendAuditLog(value []byte) {
+	logFile, err := os.OpenFile(auditLogFile(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		fmt.Printf("Unable to open audit log %s, Error: %s \n", auditLogFile(), err)
+		return
+	}
+	defer logFile.Close()
+
+	if _, err := logFile.Write(append(value, '\n')); err != nil {
+		fmt.Printf("Unable to write audit log %s, Error: %s \n", auditLogFile(), err)
+	}
+}
+
+func readAuditRecords() []AuditRecord {
+	if auditStore() == "file" {
+		return readAuditLog()
+	}
+
+	kvps, _, err := utils.GetConsulClient().KV().List(AUDIT_CONSUL_PATH, nil)
+	if err != nil {
+		fmt.Printf("Unable to read audit records from consul, Error: %s \n", err)
+		exitWith(ERR_AUDIT)
+	}
+
+	records := make([]AuditRecord, 0, len(kvps))
+	for _, kvp := range kvps {
+		var record AuditRecord
+		if err := json.Unmarshal(kvp.Value, &record); err != nil {
+			fmt.Printf("Skipping malformed audit record %s, Error: %s \n", kvp.Key, err)
+			continue
+		}
+		records = append(records, record)
+	}
+
+	return records
+}
+
+func readAuditLog() []AuditRecord {
+	records := make([]AuditRecord, 0)
+
+	logFile, err := os.Open(auditLogFile())
+	if os.IsNotExist(err) {
+		return records
+	}
+	if err != nil {
+		fmt.Printf("Unable to open audit log %s, Error: %s \n", auditLogFile(), err)
+		exitWith(ERR_AUDIT)
+	}
+	defer logFile.Close()
+
+	scanner := bufio.NewScanner(logFile)
+	for scanner.Scan() {
+		var record AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		records = append(records, record)
+	}
+
+	return records
+}
+
+func filterAuditRecords(records []AuditRecord, job string, env string, since time.Time) []AuditRecord {
+	filtered := make([]AuditRecord, 0)
+
+	for _, record := range records {
+		if job != "" && record.JobID != job {
+			continue
+		}
+		if env != "" && record.Env != env {
+			continue
+		}
+		if record.Time.Before(since) {
+			continue
+		}
+		filtered = append(filtered, record)
+	}
+
+	sort.Slice(filtered, func(i, j int) bool {
+		return filtered[i].Time.Before(filtered[j].Time)
+	})
+
+	return filtered
+}
+
+// Accepts a duration (24h) or a date (2019-06-01, 2019-06-01T10:00:00Z).
+func parseSince(since string) (time.Time, error) {
+	if since == "" {
+		return time.Time{}, nil
+	}
+	if duration, err := time.ParseDuration(since); err == nil {
+		return time.Now().Add(-duration), nil
+	}
+	if date, err := time.Parse(time.RFC3339, since); err == nil {
+		return date, nil
+	}
+
+	return time.Parse("2006-01-02", since)
+}
+
+func printAuditRecords(records []AuditRecord) {
+	for _, record := range records {
+		fmt.Printf("%s  %-8s %-10s %s@%s  %s \n", record.Time.Local().Format("2006-01-02 15:04:05"),
+			record.Result, record.Env, record.User, record.Hostname, record.Command)
+		if record.JobID != "" {
+			fmt.Printf("    job: %s  file hash: %s  images: %s \n", record.JobID, record.FileHash, strings.Join(record.Images, ", "))
+		}
+		if record.JobSource != "" {
+			fmt.Printf("    source: %s \n", record.JobSource)
+		}
+		if record.ApprovalID != "" {
+			fmt.Printf("    approval: %s \n", record.ApprovalID)
+		}
+		if record.BreakGlass != "" {
+			fmt.Printf("    break glass: %s \n", record.BreakGlass)
+		}
+	}
+}
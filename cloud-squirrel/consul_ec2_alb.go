@@ -3,7 +3,6 @@ package main
 import (
 	"fmt"
 	"log"
-	"os"
 	"strings"
 	"time"
 
@@ -15,6 +14,10 @@ import (
 	consul "github.com/hashicorp/consul/api"
 )
 
+const (
+	ERR_ALB_SYNC = 43
+)
+
 type TargetGroup struct {
 	arn               string
 	awsRegion         string
@@ -50,8 +53,8 @@ func updateTargetGroups(AWS_KEY_ID string, AWS_ACCESS_KEY string, env string) {
 	awsConfig, err := utils.GetAWSConfigFromVault(AWS_KEY_ID, AWS_ACCESS_KEY, env)
 
 	if err != nil {
-		log.Fatal(err)
-		os.Exit(13)
+		fmt.Printf("Unable to get the AWS credentials of env %s to sync the ALB target groups, Error: %s \n", env, err)
+		exitWith(ERR_ALB_SYNC)
 	}
 
 	datacenter := utils.GetConfigString("consul_datacenter")
@@ -71,7 +74,8 @@ func updateTargetGroups(AWS_KEY_ID string, AWS_ACCESS_KEY string, env string) {
 		targetGroup, error := NewTargetGroup(targetGroupConfig, awsConfig)
 
 		if error != nil {
-			log.Fatal(error)
+			fmt.Printf("Unable to sync the ALB target group of service %s, Error: %s \n", ServiceName, error)
+			exitWith(ERR_ALB_SYNC)
 		}
 		if error == nil {
 			targetGroup.update_target_group()
@@ -87,8 +91,8 @@ func updateTargetGroup(AWS_KEY_ID string, AWS_ACCESS_KEY string, env string, ser
 	awsConfig, err := utils.GetAWSConfigFromVault(AWS_KEY_ID, AWS_ACCESS_KEY, env)
 
 	if err != nil {
-		log.Fatal(err)
-		os.Exit(13)
+		fmt.Printf("Unable to get the AWS credentials of env %s to sync the ALB target groups, Error: %s \n", env, err)
+		exitWith(ERR_ALB_SYNC)
 	}
 
 	datacenter := utils.GetConfigString("consul_datacenter")
@@ -99,12 +103,15 @@ func updateTargetGroup(AWS_KEY_ID string, AWS_ACCESS_KEY string, env string, ser
 
 		if targetGroupConfig.TargetGroupARN != "" {
 
-			time.Sleep(1 * time.Minute)
+			if !dryRun {
+				time.Sleep(1 * time.Minute)
+			}
 
 			targetGroup, error := NewTargetGroup(targetGroupConfig, awsConfig)
 
 			if error != nil {
-				log.Fatal(error)
+				fmt.Printf("Unable to sync the ALB target group of service %s, Error: %s \n", serviceInTask.Name, error)
+				exitWith(ERR_ALB_SYNC)
 			}
 			if error == nil {
 				targetGroup.update_target_group()
@@ -187,6 +194,11 @@ func (tg *TargetGroup) update_target_group() {
 	toAdd := allSet.Subtract(albSet)
 	toRemove := allSet.Subtract(consulSet)
 
+	if dryRun {
+		printDryRun("would add %s to and remove %s from %q \n", toAdd, toRemove, tg.arn)
+		return
+	}
+
 	// We'll deal with adding first, since in a catastrophic
 	// failure situation it's adding things that is more likely
 	// to restore service, and the ALB itself has probably already
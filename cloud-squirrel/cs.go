@@ -18,21 +18,10 @@ import (
 	"os/exec"
 	"strconv"
 	"strings"
-
-	"github.com/hashicorp/nomad/jobspec"
-
-	"path/filepath"
+	"time"
 
 	consulapi "github.com/hashicorp/consul/api"
 	nomadapi "github.com/hashicorp/nomad/api"
-
-	discover "github.com/hashicorp/go-discover"
-
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
 type (
@@ -58,6 +47,7 @@ const (
 	ERR_DOCKER_BUILDER                        = 2
 	ERR_AWS                                   = 5
 	ERR_FAILED_TO_RENEW_OR_CREATE_CERTIFICATE = 7
+	ERR_SCALE                                 = 24
 	EXIT_SUCCESS                              = 0
 
 	DOCKER_REGISTRY_KEY = "nexus-docker-reg"
@@ -73,7 +63,7 @@ func exec_cmd(cmd string) string {
 	if err != nil {
 		cmd = utils.AwsCredentialsCleanup(cmd)
 		fmt.Printf("Error executing command: %s , Err: %s \n", cmd, err)
-		os.Exit(ERR_EXEC_CMD)
+		exitWith(ERR_EXEC_CMD)
 	}
 
 	return string(out[:])
@@ -85,12 +75,31 @@ func exec_shell_cmd(cmd string) string {
 	if err != nil {
 		cmd = utils.AwsCredentialsCleanup(cmd)
 		fmt.Printf("Error executing shell command: %s , Error: %s \n", cmd, err)
-		os.Exit(ERR_EXEC_CMD)
+		exitWith(ERR_EXEC_CMD)
 	}
 
 	return string(out[:])
 }
 
+// Runs a command that changes something, in dry run mode the command is only printed.
+func exec_mutating_cmd(cmd string) string {
+	if dryRun {
+		printDryRun("would run: %s \n", cmd)
+		return ""
+	}
+
+	return exec_cmd(cmd)
+}
+
+func exec_mutating_shell_cmd(cmd string) string {
+	if dryRun {
+		printDryRun("would run: %s \n", cmd)
+		return ""
+	}
+
+	return exec_shell_cmd(cmd)
+}
+
 func get_key(key string, consulClient *consulapi.Client) int {
 	kvpair, _, err := consulClient.KV().Get(key, nil)
 
@@ -100,13 +109,13 @@ func get_key(key string, consulClient *consulapi.Client) int {
 
 	if err != nil {
 		fmt.Printf("ERR get key: %s \n", err)
-		os.Exit(7)
+		exitWith(7)
 	}
 
 	val, err := strconv.Atoi(string(kvpair.Value))
 	if err != nil {
 		fmt.Printf("ERR atoi: %s \n", err)
-		os.Exit(10)
+		exitWith(10)
 	}
 
 	return val
@@ -126,20 +135,82 @@ func checkQuotaUsage(quota_key string, parsedFile *nomadapi.Job, consulAddress s
 	quota_limit := get_key(quota_limit_key, consulClient)
 	quota_usage := get_key(quota_usage_key, consulClient)
 
-	requested_resource_amount := 0
-	switch quota_key {
-	case "cpu":
-		requested_resource_amount = *parsedFile.TaskGroups[0].Tasks[0].Resources.CPU
-	case "memory":
-		requested_resource_amount = *parsedFile.TaskGroups[0].Tasks[0].Resources.MemoryMB
-	default:
-		fmt.Println("Unexpected quota type:", quota_usage_key)
-		os.Exit(12)
+	requested_resource_amount := jobResourceAmount(quota_key, parsedFile)
+
+	// the usage already includes the running version of the job (periodic and parameterized parents are not
+	// accounted, their child jobs are), a redeploy only changes it by the difference
+	runningJob, _, err := utils.GetNomadClient().Jobs().Info(jobID(parsedFile), nil)
+	if err == nil && runningJob.Status != nil && (*runningJob.Status == "running" || *runningJob.Status == "pending") &&
+		!runningJob.IsPeriodic() && !runningJob.IsParameterized() &&
+		utils.BuildNomadQuotaKey(quota_key, runningJob.Constraints) == quota_key_property {
+		requested_resource_amount -= jobResourceAmount(quota_key, runningJob)
 	}
 
 	if requested_resource_amount+quota_usage > quota_limit {
 		fmt.Printf(quota_key+" limit exceeded. Will not start job. Quota limit=%d . Quota key:%s \n", quota_limit, quota_usage_key)
-		os.Exit(ERR_QUOTA_LIMIT_EXCEEDED)
+		exitWith(ERR_QUOTA_LIMIT_EXCEEDED)
+	}
+}
+
+// Sums the resources of all the tasks of the job times the count of their group, the same way
+// update_quotas_usage accounts for a running job.
+func jobResourceAmount(quota_key string, parsedFile *nomadapi.Job) int {
+	amount := 0
+	for _, taskGroup := range parsedFile.TaskGroups {
+		count := 1
+		if taskGroup.Count != nil {
+			count = *taskGroup.Count
+		}
+		amount += groupResourceAmount(quota_key, taskGroup) * count
+	}
+
+	return amount
+}
+
+// Sums the resources of the tasks of one instance of the group.
+func groupResourceAmount(quota_key string, taskGroup *nomadapi.TaskGroup) int {
+	amount := 0
+
+	for _, task := range taskGroup.Tasks {
+		if task.Resources == nil {
+			continue
+		}
+
+		switch quota_key {
+		case "cpu":
+			if task.Resources.CPU != nil {
+				amount += *task.Resources.CPU
+			}
+		case "memory":
+			if task.Resources.MemoryMB != nil {
+				amount += *task.Resources.MemoryMB
+			}
+		default:
+			fmt.Println("Unexpected quota type:", quota_key)
+			exitWith(12)
+		}
+	}
+
+	return amount
+}
+
+// Checks that changing the quota usage by delta keeps it within the quota limit.
+func checkQuotaDelta(quota_key string, constraints []*nomadapi.Constraint, delta int, consulClient *consulapi.Client) {
+	checkQuotaKeyDelta(quota_key, utils.BuildNomadQuotaKey(quota_key, constraints), delta, consulClient)
+}
+
+func checkQuotaKeyDelta(quota_key string, quota_key_property string, delta int, consulClient *consulapi.Client) {
+
+	quota_limit_key := fmt.Sprintf("quotas/limit/%s", quota_key_property)
+	quota_usage_key := fmt.Sprintf("quotas/usage/%s", quota_key_property)
+
+	quota_limit := get_key(quota_limit_key, consulClient)
+	quota_usage := get_key(quota_usage_key, consulClient)
+
+	if delta > 0 && delta+quota_usage > quota_limit {
+		fmt.Printf(quota_key+" limit exceeded. Requested change: +%d, quota usage=%d, quota limit=%d . Quota key:%s \n",
+			delta, quota_usage, quota_limit, quota_usage_key)
+		exitWith(ERR_QUOTA_LIMIT_EXCEEDED)
 	}
 }
 
@@ -148,62 +219,103 @@ func checkNodeClass(nodeClassFromNomadJobFile, nodeClassFromPropertiesFile strin
 		fmt.Printf(" Node class from nomad jobfile(%s) doesnt contain node class from properties file(%s). Please put supported node class in the job file. Exiting. \n",
 			nodeClassFromNomadJobFile, nodeClassFromPropertiesFile)
 
-		os.Exit(ERR_MISSING_CONFIG_PROPERTY)
+		exitWith(ERR_MISSING_CONFIG_PROPERTY)
 	}
 
 	if !isValidNodeClass[nodeClassFromNomadJobFile] {
 		fmt.Printf("Unsupported node class:(%s). Please put supported node class in the job file. Exiting. \n",
 			nodeClassFromNomadJobFile)
 
-		os.Exit(ERR_MISSING_CONFIG_PROPERTY)
+		exitWith(ERR_MISSING_CONFIG_PROPERTY)
 	}
 }
 
-func checkNomadJobFile(job_file string, consulAddress string, consulClient *consulapi.Client, isValidNodeClass map[string]bool) (string, []Service) {
-	path, err := filepath.Abs(job_file)
-	if err != nil {
-		fmt.Printf(" Unable to open nomad job file: %s, Error:  %s \n", job_file, err)
-		os.Exit(1)
-	}
+func checkNomadJobFile(parsedFile *nomadapi.Job, consulAddress string, consulClient *consulapi.Client, isValidNodeClass map[string]bool) []Service {
+	checkJobConstraints(parsedFile, isValidNodeClass)
+	checkJobEnvironment(parsedFile)
+	checkJobImages(parsedFile)
+	checkStaticPorts(parsedFile)
 
-	parsedFile, err := jobspec.ParseFile(path)
-	if err != nil {
-		fmt.Printf("Unable to parse nomad job file: %s, Error:%s \n", job_file, err)
-		os.Exit(2)
-	}
+	checkQuotaUsage("cpu", parsedFile, consulAddress, consulClient)
+	checkQuotaUsage("memory", parsedFile, consulAddress, consulClient)
 
+	return jobServices(parsedFile)
+}
+
+// The checks of checkNomadJobFile that don't depend on the quota usage.
+func checkJobConstraints(parsedFile *nomadapi.Job, isValidNodeClass map[string]bool) {
 	utils.ValidateConstraint(parsedFile.Constraints, utils.NOMAD_GROUP_CONSTRAINT)
 	utils.ValidateConstraint(parsedFile.Constraints, utils.NOMAD_ENV_CONSTRAINT)
 
-	checkQuotaUsage("cpu", parsedFile, consulAddress, consulClient)
-	checkQuotaUsage("memory", parsedFile, consulAddress, consulClient)
-
 	checkNodeClass(utils.GetConstraintValue(parsedFile.Constraints,
 		"${node.class}"), utils.GetConfigString("node_class"), isValidNodeClass)
+}
 
+func jobServices(parsedFile *nomadapi.Job) []Service {
 	servicesArrayInJob := make([]Service, 0)
 	taskGroups := parsedFile.TaskGroups
 
 	for _, taskGroup := range taskGroups {
-		tasks := taskGroup.Tasks
-		for _, task := range tasks {
-			servicesInTask := task.Services
-			for _, serviceInTask := range servicesInTask {
-				seviceObj := Service{
-					Name: serviceInTask.Name,
-				}
-				servicesArrayInJob = append(servicesArrayInJob, seviceObj)
+		servicesArrayInJob = append(servicesArrayInJob, groupServices(taskGroup)...)
+	}
+
+	return servicesArrayInJob
+}
+
+func groupServices(taskGroup *nomadapi.TaskGroup) []Service {
+	servicesArrayInGroup := make([]Service, 0)
+
+	tasks := taskGroup.Tasks
+	for _, task := range tasks {
+		servicesInTask := task.Services
+		for _, serviceInTask := range servicesInTask {
+			seviceObj := Service{
+				Name: serviceInTask.Name,
 			}
+			servicesArrayInGroup = append(servicesArrayInGroup, seviceObj)
 		}
 	}
 
-	return path, servicesArrayInJob
+	return servicesArrayInGroup
 }
 
 func buildNomadCommand() string {
 	return " export NOMAD_ADDR=" + utils.GetConfigString("nomad_server") + " && " + NOMAD_BINARY
 }
 
+func runNomadJob(parsedFile *nomadapi.Job, deployOptions *DeployOptions, awsEnv string) {
+	if deployOptions.Detach && deployOptions.AutoRollback {
+		releaseDeployLock()
+		utils.ExitErrorf("--auto-rollback watches the deployment and can't be combined with --detach")
+	}
+
+	nomadClient := utils.GetNomadClient()
+
+	var stableJob *nomadapi.Job
+	if deployOptions.AutoRollback {
+		stableJob = previousStableJob(nomadClient, jobID(parsedFile))
+	}
+
+	auditJob(parsedFile)
+
+	// on success the caller syncs the ALB target groups before it finishes the audit record
+	_, exitCode := submitNomadJob(nomadClient, parsedFile, deployOptions)
+	if exitCode == EXIT_SUCCESS {
+		return
+	}
+
+	if deployOptions.AutoRollback && exitCode != ERR_NOMAD_API {
+		if rollbackNomadJob(nomadClient, stableJob, deployOptions.Timeout) == EXIT_SUCCESS {
+			updateTargetGroup(AWS_KEY_ID, AWS_ACCESS_KEY, awsEnv, jobServices(stableJob))
+			restoreQuotaUsage()
+		} else {
+			exitCode = ERR_ROLLBACK_FAILED
+		}
+	}
+
+	exitWith(exitCode)
+}
+
 func main() {
 
 	isValidNodeClass := map[string]bool{
@@ -217,6 +329,32 @@ func main() {
 	var Tag string
 	var Directory string
 	var File string
+	var jobFileOptions JobFileOptions
+	var renderJob bool
+	var artifactTask string
+	var deployOptions DeployOptions
+	var dispatchMeta []string
+	var stackFile string
+	var historyJob string
+	var historyEnv string
+	var historySince string
+	var promoteFrom string
+	var promoteTo string
+	var promoteFile string
+	var lockWait time.Duration
+	var breakGlassReason string
+	var approvalExpires time.Duration
+	var approvalComment string
+	var diffProfiles []string
+	var diffShowAll bool
+	var rightsizeWindow time.Duration
+	var rightsizeInterval time.Duration
+	var rightsizeHeadroom int
+	var initOptions JobScaffold
+	var initOutput string
+	var initTargetGroupARN string
+	utils.Exit = exitWith
+
 	viper.SetConfigName("cs") // name of config file (without extension)
 	viper.AddConfigPath("$HOME/.cs")
 	err := viper.ReadInConfig()
@@ -230,6 +368,7 @@ func main() {
 	vaultRole := utils.GetConfigString("vault_role")
 	datacenter := utils.GetConfigString("consul_datacenter")
 	awsEnv := utils.GetConfigString("env")
+	redactSecrets(vaultToken)
 
 	config := consulapi.DefaultConfig()
 	config.Address = consulAddress
@@ -238,7 +377,7 @@ func main() {
 	consulClient, err := consulapi.NewClient(config)
 	if err != nil {
 		fmt.Printf("Unable to create client(%v): %v", consulAddress, err)
-		os.Exit(1)
+		exitWith(1)
 	}
 
 	var cmdQuota = &cobra.Command{
@@ -256,79 +395,653 @@ func main() {
 
 			switch quota_sub_command {
 			case "init":
-				exec_cmd(fmt.Sprintf(CONSUL_BINARY+" kv put -http-addr=%s  quotas/limit/%s  %s", consulAddress,
+				startAudit(cmd, args)
+				exec_mutating_cmd(fmt.Sprintf(CONSUL_BINARY+" kv put -http-addr=%s  quotas/limit/%s  %s", consulAddress,
 					args[1],
 					args[2]))
+				finishAudit(EXIT_SUCCESS)
 			case "usage":
 				exec_cmd(fmt.Sprintf(CONSUL_BINARY+" kv get -recurse -http-addr=%s quotas ", consulAddress))
 			default:
 				fmt.Println("Unexpected quota_sub_command:", quota_sub_command)
-				os.Exit(13)
+				exitWith(13)
 			}
 		},
 	}
 
 	var cmdRun = &cobra.Command{
-		Use:   "run [job_file] {args}",
+		Use:   "run [job_file]",
 		Short: "Run a nomad job.",
 		Long: `Run a nomad job with checks for quota limits.
                 If a given limit is exceeded then the job will not run. Limits could be cpu, memory etc.
+                HCL1, HCL2 (with -var and -var-file) and JSON job files are supported.
+                Placeholders like ${cs:discover "..."}, ${cs:consul "kv/path"} and ${cs:service "name"}
+                in the job file are resolved before the job is submitted, the job file is not modified.
+                Every docker image of the job must exist in its registry.
+                The command waits until the deployment is healthy. Exit codes: 19 placement failed,
+                20 deployment failed, 21 timeout. Use --detach to return right after the job is registered.
+                With --auto-rollback canaries are promoted once healthy, and a failed deployment is reverted
+                to the previous stable version (exit code 22 if the rollback fails as well).
+                Deploys of the same job are serialized by a deploy lock, see cs lock (--lock-wait, exit code 31).
+                During a freeze of the job's env the job is refused (exit code 32) unless --break-glass "reason" is given.
+                Profiles with require_approval=true need an approval of the job from cs approve (exit code 34).
+                Exit code 41 if the job file can't be read, 42 if it can't be parsed, 43 if the ALB sync after the deploy fails.
+                Only the job file is accepted: the job is not run by nomad run anymore, so extra arguments are
+                not passed through to it. Use the cs flags instead (--detach, --var, --var-file).
                    Example:
-                   cs run scoring_job.nomad`,
-		Args: cobra.MinimumNArgs(1),
+                   cs run scoring_job.nomad
+                   cs run --var image_tag=1.0.2 scoring_job.nomad
+                   to run a job file from S3, a git repo at a ref or Consul KV:
+                   cs run s3://ci-jobs/scoring/scoring.nomad
+                   cs run git::https://github.com/org/jobs.git//scoring/scoring.nomad?ref=v1.2.0
+                   cs run consul://jobs/scoring
+                   to merge scoring_job.uat.yaml and/or scoring_job.uat.vars into the job:
+                   cs run --env uat scoring_job.nomad
+                   to only print the merged job:
+                   cs run --env uat --render scoring_job.nomad`,
+		Args: cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
 
 			job_file := args[0]
-			path, servicesInTask := checkNomadJobFile(job_file, consulAddress, consulClient, isValidNodeClass)
 
-			log.Printf("File Path %", path)
+			if !renderJob {
+				startAudit(cmd, args)
+			}
 
-			// if we want to run consul server as a Docker image we need to get the join ip of a standalone instance and put that as -join parameter in the config
-			// the reson for this is because for some reason -join by aws tags does not work when running consul server from Docker container
-			if strings.Contains(job_file, "consul-server") {
-				d := discover.Discover{
-					Providers: map[string]discover.Provider{
-						"aws": discover.Providers["aws"],
-					},
-				}
+			path, parsedFile := parseNomadJobFile(job_file, &jobFileOptions)
+			if renderJob {
+				fmt.Println(string(renderNomadJob(parsedFile)))
+				return
+			}
 
-				l := log.New(os.Stderr, "", log.LstdFlags)
+			servicesInTask := checkNomadJobFile(parsedFile, consulAddress, consulClient, isValidNodeClass)
 
-				cfg := "provider=aws tag_key=join_tag tag_value=consul-server"
-				addrs, err := d.Addrs(cfg, l)
-				if err != nil {
-					utils.ExitErrorf("Unable to get consul-server IPs from AWS tags. Error: %v", err)
-				}
+			log.Printf("File Path %s", path)
 
-				consulJoinIp := addrs[0]
-				exec_shell_cmd(fmt.Sprintf(` sed -i  -e 's|CONSUL_JOIN_IP|%s|'  %s    `, consulJoinIp, job_file))
-			}
+			checkDeployFreeze(consulClient, parsedFile, breakGlassReason)
+			checkJobApproval(consulClient, parsedFile)
+			acquireDeployLock(consulClient, jobID(parsedFile), lockWait)
 
-			exec_shell_cmd(fmt.Sprintf(buildNomadCommand()+" run   %s", build_cmd_args(args)))
+			runNomadJob(parsedFile, &deployOptions, awsEnv)
 
 			updateTargetGroup(AWS_KEY_ID, AWS_ACCESS_KEY, awsEnv, servicesInTask)
+			releaseDeployLock()
+			finishAudit(EXIT_SUCCESS)
 		},
 	}
 
 	var cmdRunArtifactID = &cobra.Command{
-		Use:   "run-artifact-id [artifact-id] [job_file] {args}",
+		Use:   "run-artifact-id [artifact-id | task=artifact-id,...] [job_file]",
 		Short: "Run a nomad job using a specific version of the Docker artifact.",
 		Long: `Run a nomad job with checks for quota limits.
 	                If a given limit is exceeded then the job will not run. Limits could be cpu, memory etc.
+	                The artifact id replaces the repository and tag of the task's image, the registry is kept.
+	                The job file itself is not modified, the job that is submitted is printed.
 	                   Example:
-	                   cs run scoring_job.nomad`,
-		Args: cobra.MinimumNArgs(2),
+	                   cs run-artifact-id rcs/clean-sweep:1.01 scoring_job.nomad
+	                   cs run-artifact-id --task api rcs/scoring-api:1.01 scoring_job.nomad
+	                   cs run-artifact-id api=rcs/scoring-api:1.01,worker=rcs/scoring-worker:1.01 scoring_job.nomad`,
+		Args: cobra.ExactArgs(2),
 		Run: func(cmd *cobra.Command, args []string) {
 
+			if !renderJob {
+				startAudit(cmd, args)
+			}
+
+			artifactIds, err := parseArtifactIds(args[0], artifactTask)
+			if err != nil {
+				fmt.Printf("Invalid artifact id: %s, Error: %s \n", args[0], err)
+				exitWith(ERR_ARTIFACT_ID)
+			}
+
 			job_file := args[1]
-			path, servicesInTask := checkNomadJobFile(job_file, consulAddress, consulClient, isValidNodeClass)
+			_, parsedFile := parseNomadJobFile(job_file, &jobFileOptions)
+
+			if err := applyArtifactIds(parsedFile, artifactIds); err != nil {
+				fmt.Printf("Unable to apply artifact id: %s, Error: %s \n", args[0], err)
+				exitWith(ERR_ARTIFACT_ID)
+			}
+
+			if renderJob {
+				fmt.Println(string(renderNomadJob(parsedFile)))
+				return
+			}
 
-			artifactId := args[0]
-			exec_shell_cmd(fmt.Sprintf(` sed -i  -e 's|\(image = \".*\)/.*/.*\:.*\"|\1/%s\"|'  %s    `, artifactId, path))
+			servicesInTask := checkNomadJobFile(parsedFile, consulAddress, consulClient, isValidNodeClass)
 
-			exec_shell_cmd(fmt.Sprintf(buildNomadCommand()+" run   %s", build_cmd_args(args[1:])))
+			checkDeployFreeze(consulClient, parsedFile, breakGlassReason)
+			checkJobApproval(consulClient, parsedFile)
+			acquireDeployLock(consulClient, jobID(parsedFile), lockWait)
+
+			fmt.Printf("Submitting job: \n%s \n", renderNomadJob(parsedFile))
+
+			runNomadJob(parsedFile, &deployOptions, awsEnv)
 
 			updateTargetGroup(AWS_KEY_ID, AWS_ACCESS_KEY, awsEnv, servicesInTask)
+			releaseDeployLock()
+			finishAudit(EXIT_SUCCESS)
+		},
+	}
+
+	var cmdValidate = &cobra.Command{
+		Use:   "validate [job_file]",
+		Short: "Validate a nomad job file.",
+		Long: `Parse a nomad job file and run the same checks as the run command without submitting the job.
+                HCL1, HCL2 (with -var and -var-file) and JSON job files are supported.
+                   Example:
+                   cs validate scoring_job.nomad
+                   cs validate --var image_tag=1.0.2 --var-file prod.vars scoring_job.nomad`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+
+			job_file := args[0]
+			_, parsedFile := parseNomadJobFile(job_file, &jobFileOptions)
+			if renderJob {
+				fmt.Println(string(renderNomadJob(parsedFile)))
+				return
+			}
+
+			checkNomadJobFile(parsedFile, consulAddress, consulClient, isValidNodeClass)
+
+			fmt.Printf("Job file %s (job id: %s, job hash: %s) is valid. \n", job_file, jobID(parsedFile), contentHash(renderNomadJob(parsedFile)))
+		},
+	}
+
+	var cmdDrift = &cobra.Command{
+		Use:   "drift [dir]",
+		Short: "Compare the job files of a directory with the jobs running in nomad.",
+		Long: `Parse every job file (*.nomad, *.hcl, *.nomad.json) under a directory and compare it with the
+                running job of the same id: images, counts, resources, constraints and services.
+                Exits with code 35 if any job drifted, is not running or failed to parse.
+                   Example:
+                   cs drift jobs/
+                   cs drift --env prod jobs/`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+
+			if detectDrift(utils.GetNomadClient(), args[0], &jobFileOptions) {
+				exitWith(ERR_DRIFT)
+			}
+		},
+	}
+
+	var cmdDiffEnv = &cobra.Command{
+		Use:   "diff-env [job_id] --profiles [profile,profile,...]",
+		Short: "Compare a running job between environments.",
+		Long: `Fetch the running job from the nomad cluster of each profile and show them side by side:
+                images, counts, resources, env vars, constraints and services. Rows that differ are marked with *,
+                only those are shown unless --all is given.
+                   Example:
+                   cs diff-env scoring --profiles uat,prod`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+
+			if len(diffProfiles) < 2 {
+				fmt.Println("please provide at least two profiles with --profiles")
+				exitWith(ERR_DIFF_ENV)
+			}
+
+			compareJobAcrossProfiles(args[0], diffProfiles, diffShowAll)
+		},
+	}
+
+	var cmdInit = &cobra.Command{
+		Use:   "init [name] --group [group] --image [image] --port [port]",
+		Short: "Generate a job file for a new service.",
+		Long: `Generate <name>.nomad with the ${meta.group}, ${meta.env} and ${node.class} constraints cs run requires,
+                a docker task with the image, an http port and a service tagged "http" so the ALB sync picks it up.
+                The env and node class default to the ones of the active profile, cpu/memory to the node class defaults.
+                The generated job is checked the same way cs run checks a job: constraints, env, static ports, images and quotas.
+                With --target-group-arn the service is also mapped to its ALB target group.
+                   Example:
+                   cs init scoring --group analytics --image registry/scoring:1.0.0 --port 8080
+                   cs init scoring --group analytics --image registry/scoring:1.0.0 --port 8080 --target-group-arn arn:aws:...`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+
+			if initOptions.Group == "" || initOptions.Image == "" || initOptions.Port <= 0 {
+				fmt.Println("please provide --group, --image and --port")
+				exitWith(ERR_INIT)
+			}
+
+			scaffold := newJobScaffold(args[0], initOptions.Group, initOptions.Env, initOptions.NodeClass, initOptions.Image, initOptions.Port)
+			jobFile := initOutput
+			if jobFile == "" {
+				jobFile = args[0] + ".nomad"
+			}
+			initJobFile(scaffold, jobFile, isValidNodeClass, consulAddress, consulClient)
+
+			if initTargetGroupARN != "" {
+				startAudit(cmd, args)
+				registerTargetGroup(utils.GetConsulClient(), args[0], initTargetGroupARN)
+				finishAudit(EXIT_SUCCESS)
+			}
+		},
+	}
+
+	var cmdRightsize = &cobra.Command{
+		Use:   "rightsize [job_id]",
+		Short: "Recommend cpu and memory for the tasks of a job from their resource usage.",
+		Long: `Sample the resource usage of the running allocations of a job from the nomad client API over a window,
+                and recommend cpu/memory values: the peak usage plus headroom. Shows how much quota the
+                recommended values would free in the job's env--group.
+                   Example:
+                   cs rightsize scoring --window 1h --headroom 30`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+
+			if rightsizeInterval <= 0 || rightsizeHeadroom < 0 {
+				fmt.Println("--interval must be positive and --headroom can't be negative")
+				exitWith(ERR_RIGHTSIZE)
+			}
+
+			rightsizeJob(utils.GetNomadClient(), args[0], rightsizeWindow, rightsizeInterval, rightsizeHeadroom)
+		},
+	}
+
+	var cmdRollback = &cobra.Command{
+		Use:   "rollback [job_id] {version}",
+		Short: "Roll back a nomad job to a previous version.",
+		Long: `List the versions of a nomad job, or revert the job to a previous version.
+                Without a version the versions are listed with their Docker images and what changed.
+                With a version the quotas are checked for that version, the job is reverted and
+                the ALB target groups of its services are synced the same way as after cs run.
+                   Example:
+                   cs rollback scoring
+                   cs rollback scoring 4`,
+		Args: cobra.RangeArgs(1, 2),
+		Run: func(cmd *cobra.Command, args []string) {
+
+			// listing the versions doesn't change anything
+			if len(args) == 2 {
+				startAudit(cmd, args)
+			}
+
+			job_id := args[0]
+			nomadClient := utils.GetNomadClient()
+
+			versions, diffs, _, err := nomadClient.Jobs().Versions(job_id, true, nil)
+			if err != nil {
+				fmt.Printf("Unable to get versions of job %s, Error: %s \n", job_id, err)
+				exitWith(ERR_NOMAD_API)
+			}
+
+			if len(args) == 1 {
+				printJobVersions(versions, diffs)
+				return
+			}
+
+			version, err := strconv.ParseUint(args[1], 10, 64)
+			if err != nil {
+				fmt.Printf("Invalid job version: %s, Error: %s \n", args[1], err)
+				exitWith(ERR_JOB_VERSION)
+			}
+
+			targetJob := findJobVersion(versions, version)
+			if targetJob == nil {
+				fmt.Printf("Job %s has no version %d \n", job_id, version)
+				exitWith(ERR_JOB_VERSION)
+			}
+
+			currentJob := versions[0]
+			if *currentJob.Version == version {
+				fmt.Printf("Job %s is already at version %d \n", job_id, version)
+				exitWith(ERR_JOB_VERSION)
+			}
+
+			auditJob(targetJob)
+			checkDeployFreeze(consulClient, targetJob, breakGlassReason)
+
+			for _, quota_key := range []string{"cpu", "memory"} {
+				delta := jobResourceAmount(quota_key, targetJob)
+				if utils.BuildNomadQuotaKey(quota_key, targetJob.Constraints) == utils.BuildNomadQuotaKey(quota_key, currentJob.Constraints) {
+					delta -= jobResourceAmount(quota_key, currentJob)
+				}
+				checkQuotaDelta(quota_key, targetJob.Constraints, delta, consulClient)
+			}
+
+			if exitCode := rollbackNomadJob(nomadClient, targetJob, deployOptions.Timeout); exitCode != EXIT_SUCCESS {
+				exitWith(exitCode)
+			}
+
+			updateTargetGroup(AWS_KEY_ID, AWS_ACCESS_KEY, awsEnv, jobServices(targetJob))
+			restoreQuotaUsage()
+			finishAudit(EXIT_SUCCESS)
+		},
+	}
+
+	var cmdScale = &cobra.Command{
+		Use:   "scale [job_id] [group] [count]",
+		Short: "Change the count of a task group with checks for quota limits.",
+		Long: `Scale a task group of a running nomad job.
+                The resources needed for the new count are checked against the quota limits of the job,
+                then the group is scaled and the ALB target groups of the group's services are synced.
+                   Example:
+                   cs scale scoring scoring-api 4`,
+		Args: cobra.ExactArgs(3),
+		Run: func(cmd *cobra.Command, args []string) {
+
+			startAudit(cmd, args)
+
+			job_id := args[0]
+			group := args[1]
+			count, err := strconv.Atoi(args[2])
+			if err != nil || count < 0 {
+				fmt.Printf("Invalid count: %s \n", args[2])
+				exitWith(ERR_SCALE)
+			}
+
+			nomadClient := utils.GetNomadClient()
+			runningJob, _, err := nomadClient.Jobs().Info(job_id, nil)
+			if err != nil {
+				fmt.Printf("Unable to get job %s from nomad, Error: %s \n", job_id, err)
+				exitWith(ERR_NOMAD_API)
+			}
+
+			taskGroup := findTaskGroup(runningJob, group)
+			if taskGroup == nil {
+				fmt.Printf("Job %s has no group %s \n", job_id, group)
+				exitWith(ERR_SCALE)
+			}
+
+			currentCount := 0
+			if taskGroup.Count != nil {
+				currentCount = *taskGroup.Count
+			}
+
+			auditJob(runningJob)
+			checkDeployFreeze(consulClient, runningJob, breakGlassReason)
+
+			for _, quota_key := range []string{"cpu", "memory"} {
+				delta := groupResourceAmount(quota_key, taskGroup) * (count - currentCount)
+				checkQuotaDelta(quota_key, runningJob.Constraints, delta, consulClient)
+			}
+
+			if dryRun {
+				printDryRun("would scale group %s of job %s from %d to %d \n", group, job_id, currentCount, count)
+				updateTargetGroup(AWS_KEY_ID, AWS_ACCESS_KEY, awsEnv, groupServices(taskGroup))
+				return
+			}
+
+			fmt.Printf("Scaling group %s of job %s from %d to %d \n", group, job_id, currentCount, count)
+			resp, _, err := nomadClient.Jobs().Scale(job_id, group, &count, "scaled with cs scale", false, nil, nil)
+			if err != nil {
+				fmt.Printf("Unable to scale group %s of job %s, Error: %s \n", group, job_id, err)
+				exitWith(ERR_NOMAD_API)
+			}
+
+			if !deployOptions.Detach && resp.EvalID != "" {
+				if exitCode := monitorNomadEvaluation(nomadClient, resp.EvalID, time.Now().Add(deployOptions.Timeout), false); exitCode != EXIT_SUCCESS {
+					exitWith(exitCode)
+				}
+			}
+
+			updateTargetGroup(AWS_KEY_ID, AWS_ACCESS_KEY, awsEnv, groupServices(taskGroup))
+			finishAudit(EXIT_SUCCESS)
+		},
+	}
+
+	var cmdDispatch = &cobra.Command{
+		Use:   "dispatch [job_id] {payload_file}",
+		Short: "Dispatch a parameterized job or force a run of a periodic job, with checks for quota limits.",
+		Long: `Dispatch a parameterized nomad job, or force a run of a periodic nomad job.
+                The resources of the child job are checked against the quota limits of the parent job's env--group.
+                The payload is read from the given file, "-" reads it from stdin.
+                   Example:
+                   cs dispatch report-generator payload.json --meta report=daily
+                   cs dispatch nightly-cleanup`,
+		Args: cobra.RangeArgs(1, 2),
+		Run: func(cmd *cobra.Command, args []string) {
+
+			payloadFile := ""
+			if len(args) > 1 {
+				payloadFile = args[1]
+			}
+
+			startAudit(cmd, args)
+			dispatchNomadJob(utils.GetNomadClient(), consulClient, args[0], payloadFile, dispatchMeta, &deployOptions)
+			finishAudit(EXIT_SUCCESS)
+		},
+	}
+
+	var cmdPromote = &cobra.Command{
+		Use:   "promote [job_id] --from [profile] --to [profile]",
+		Short: "Deploy the images of a job running in one environment to another.",
+		Long: `Promote the docker images of a job from the cluster of one config profile to another.
+                The images of the job running in the --from profile replace the images of the tasks with
+                the same group and name in the target job: the job file given with -f (merged with --env),
+                or else the job running in the --to profile. The changes are printed, then the job is
+                checked and deployed the same way as with cs run under the --to profile.
+                   Example:
+                   cs promote scoring --from uat --to prod
+                   cs promote scoring --from uat --to prod -f scoring.nomad --env prod`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+
+			startAudit(cmd, args)
+
+			job_id := args[0]
+			if promoteFrom == "" || promoteTo == "" || promoteFrom == promoteTo {
+				fmt.Println("please provide two different profiles with --from and --to")
+				exitWith(ERR_PROMOTE)
+			}
+
+			activateProfile(promoteFrom)
+			sourceImages := runningJobImages(utils.GetNomadClient(), job_id)
+
+			activateProfile(promoteTo)
+			targetConsulAddress := utils.GetConfigString("consul_server")
+			targetConsulClient := utils.GetConsulClient()
+			targetEnv := utils.GetConfigString("env")
+			auditProfile()
+
+			parsedFile := promoteTargetJob(job_id, promoteFile, &jobFileOptions)
+			changes, err := promoteJobImages(parsedFile, sourceImages)
+			if err != nil {
+				fmt.Printf("Unable to promote job %s from %s to %s, Error: %s \n", job_id, promoteFrom, promoteTo, err)
+				exitWith(ERR_PROMOTE)
+			}
+
+			if len(changes) == 0 {
+				fmt.Printf("The images of job %s in %s are already the images running in %s \n", job_id, promoteTo, promoteFrom)
+			}
+			for _, change := range changes {
+				fmt.Printf("  %s \n", change)
+			}
+			printPlanDiff(utils.GetNomadClient(), parsedFile)
+
+			servicesInTask := checkNomadJobFile(parsedFile, targetConsulAddress, targetConsulClient, isValidNodeClass)
+
+			checkDeployFreeze(targetConsulClient, parsedFile, breakGlassReason)
+			checkJobApproval(targetConsulClient, parsedFile)
+			acquireDeployLock(targetConsulClient, job_id, lockWait)
+
+			runNomadJob(parsedFile, &deployOptions, targetEnv)
+
+			updateTargetGroup(AWS_KEY_ID, AWS_ACCESS_KEY, targetEnv, servicesInTask)
+			releaseDeployLock()
+			finishAudit(EXIT_SUCCESS)
+		},
+	}
+
+	var cmdApply = &cobra.Command{
+		Use:   "apply -f [stack_file]",
+		Short: "Deploy a stack of nomad jobs in dependency order.",
+		Long: `Deploy the nomad jobs listed in a stack file.
+                The quotas are checked for the whole stack before anything is deployed.
+                Jobs are deployed after the jobs in their depends_on list, once the services of those
+                jobs pass their consul health checks. The first failure stops the deploy.
+                Each job is submitted under its deploy lock, like cs run, see --lock-wait.
+                   Example:
+                   cs apply -f stack.yaml`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+
+			if stackFile == "" {
+				fmt.Println("please provide the stack file with -f")
+				exitWith(ERR_STACK)
+			}
+
+			stack := readStack(stackFile)
+			stackJobs, err := sortStackJobs(stack.Jobs)
+			if err != nil {
+				fmt.Printf("Invalid stack file: %s, Error: %s \n", stackFile, err)
+				exitWith(ERR_STACK)
+			}
+
+			// every job of the stack is checked against the freezes before the first one is submitted
+			for _, stackJob := range stackJobs {
+				loadStackJob(stackJob, isValidNodeClass)
+				checkDeployFreeze(consulClient, stackJob.parsedFile, breakGlassReason)
+			}
+
+			nomadClient := utils.GetNomadClient()
+			checkStackQuota(stackJobs, nomadClient, consulClient)
+
+			exitCode := deployStack(cmd, stackJobs, nomadClient, consulClient, &deployOptions, lockWait, breakGlassReason, awsEnv)
+			printStackSummary(stackJobs)
+			exitWith(exitCode)
+		},
+	}
+
+	var cmdApprove = &cobra.Command{
+		Use:   "approve [job_id] [job_hash]",
+		Short: "Approve a job for the profiles that require approval.",
+		Long: `Record a signed approval of a job in consul KV, for profiles with require_approval=true.
+                The job hash is the hash of the rendered job, printed by cs validate and by a run that
+                is refused for lack of approval (cs --dry-run run ... shows it without deploying).
+                The approval is only valid for that exact job, in the active profile, until it expires.
+                It is signed with the vault transit key cs-approval, which only reviewers can sign with, and
+                the approver is the vault identity of the signing token. It can't be used by the same identity to deploy.
+                   Example:
+                   cs approve scoring 3f2a...c9 --expires 8h --comment "release 1.0.4"`,
+		Args: cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+
+			startAudit(cmd, args)
+			approval := approveJob(consulClient, args[0], args[1], approvalExpires, approvalComment)
+			auditApproval(approval.ID)
+
+			fmt.Printf("Approved job %s (job hash %s) in profile %s, approval %s expires %s \n", approval.JobID, approval.JobHash,
+				approval.Profile, approval.ID, approval.Expires.Local().Format("2006-01-02 15:04"))
+			finishAudit(EXIT_SUCCESS)
+		},
+	}
+
+	var cmdJobs = &cobra.Command{
+		Use:   "jobs [jobs_sub_command] {job_file | job_id} {version}",
+		Short: "Push and pull versions of rendered jobs to and from the job registry in consul KV.",
+		Long: `The job registry keeps every pushed version of a job: the rendered job, its job hash and the images
+                of its docker tasks. A version can be redeployed exactly with cs run consul://jobs/<job_id>@<version>,
+                the latest version without @<version>.
+                   Example:
+                   to push the rendered job as the next version (nothing is pushed if it's the same as the latest):
+                   cs jobs push --env prod scoring_job.nomad
+                   to list the jobs of the registry, or the versions of a job:
+                   cs jobs list
+                   cs jobs list scoring
+                   to show a version (the latest without a version):
+                   cs jobs show scoring 4
+                   to print the rendered job of a version:
+                   cs jobs pull scoring 4 > scoring_job.nomad.json
+                   to redeploy a version:
+                   cs run consul://jobs/scoring@4`,
+		Args: cobra.RangeArgs(1, 3),
+		Run: func(cmd *cobra.Command, args []string) {
+			jobs_sub_command := args[0]
+
+			version := ""
+			if len(args) == 3 {
+				version = args[2]
+			}
+
+			switch jobs_sub_command {
+			case "push":
+				if len(args) != 2 {
+					fmt.Println("please provide the job file")
+					exitWith(ERR_JOB_REGISTRY)
+				}
+				startAudit(cmd, args)
+				source, parsedFile := parseNomadJobFile(args[1], &jobFileOptions)
+				auditJob(parsedFile)
+				jobSpec := pushJobSpec(consulClient, parsedFile, source)
+				fmt.Printf("Job %s version %d, job hash %s \n", jobSpec.JobID, jobSpec.Version, jobSpec.JobHash)
+				finishAudit(EXIT_SUCCESS)
+			case "list":
+				if len(args) == 1 {
+					listRegisteredJobs(consulClient)
+				} else {
+					printJobSpecVersions(consulClient, args[1])
+				}
+			case "show":
+				if len(args) < 2 {
+					fmt.Println("please provide the job id")
+					exitWith(ERR_JOB_REGISTRY)
+				}
+				printJobSpecVersion(mustReadJobSpecVersion(consulClient, args[1], version))
+			case "pull":
+				if len(args) < 2 {
+					fmt.Println("please provide the job id")
+					exitWith(ERR_JOB_REGISTRY)
+				}
+				fmt.Println(mustReadJobSpecVersion(consulClient, args[1], version).Spec)
+			default:
+				fmt.Println("Unexpected jobs_sub_command:", jobs_sub_command)
+				exitWith(ERR_JOB_REGISTRY)
+			}
+		},
+	}
+
+	var cmdLock = &cobra.Command{
+		Use:   "lock [lock_sub_command] {job_id}",
+		Short: "List and break the deploy locks of nomad jobs.",
+		Long: `cs run, run-artifact-id and promote hold a lock per job id while the job is submitted
+                and the ALB target groups are synced, concurrent deploys of the same job wait for it.
+                   Example:
+                   to see who is deploying which job:
+                   cs lock list
+                   to free the lock of a deploy that is stuck:
+                   cs lock break scoring`,
+		Args: cobra.RangeArgs(1, 2),
+		Run: func(cmd *cobra.Command, args []string) {
+			lock_sub_command := args[0]
+
+			switch lock_sub_command {
+			case "list":
+				listDeployLocks(consulClient)
+			case "break":
+				if len(args) < 2 {
+					fmt.Println("please provide the job id")
+					exitWith(ERR_DEPLOY_LOCK)
+				}
+				startAudit(cmd, args)
+				breakDeployLock(consulClient, args[1])
+				finishAudit(EXIT_SUCCESS)
+			default:
+				fmt.Println("Unexpected lock_sub_command:", lock_sub_command)
+				exitWith(ERR_DEPLOY_LOCK)
+			}
+		},
+	}
+
+	var cmdHistory = &cobra.Command{
+		Use:   "history",
+		Short: "Show the audit trail of the cs commands that changed something.",
+		Long: `Show who ran which mutating cs command (run, run-artifact-id, rollback, scale, dispatch,
+                quota init, cert upload, builder build/push), with which job and images, into which env.
+                   Example:
+                   cs history --job scoring --env rcscorenp --since 72h
+                   cs history --since 2019-06-01`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+
+			since, err := parseSince(historySince)
+			if err != nil {
+				fmt.Printf("Invalid --since: %s, expected a duration (24h) or a date (2019-06-01) \n", historySince)
+				exitWith(ERR_AUDIT)
+			}
+
+			printAuditRecords(filterAuditRecords(readAuditRecords(), historyJob, historyEnv, since))
 		},
 	}
 
@@ -348,7 +1061,7 @@ func main() {
 
 			if len(args) > 0 && "run" == args[0] {
 				fmt.Printf(" run command is not allowed when directly invoking nomad. Use 'cs run <jobfile> ...'  \n")
-				os.Exit(-7)
+				exitWith(-7)
 			}
 			exec_shell_cmd(fmt.Sprintf(buildNomadCommand()+"  %s", build_cmd_args(args)))
 		},
@@ -369,7 +1082,7 @@ func main() {
 
 			switch cert_sub_command {
 			case "generate":
-				exec_cmd(fmt.Sprintf(" create_cert.sh %s %s %s %s %s", vaultAddress, vaultToken, vaultRole,
+				exec_mutating_cmd(fmt.Sprintf(" create_cert.sh %s %s %s %s %s", vaultAddress, vaultToken, vaultRole,
 					args[1],
 					args[2]))
 			case "upload":
@@ -377,16 +1090,19 @@ func main() {
 				if cloud_provider == "aws" {
 					awskid := utils.GetDataFromVault(AWS_KEY_ID)
 					awssak := utils.GetDataFromVault(AWS_ACCESS_KEY)
+					redactSecrets(awskid, awssak)
 
 					aws_region := utils.GetConfigString("region")
-					exec_cmd(fmt.Sprintf(" upload_cert_to_aws.sh %s %s %s", awskid, awssak, aws_region))
+					startAudit(cmd, args)
+					exec_mutating_cmd(fmt.Sprintf(" upload_cert_to_aws.sh %s %s %s", awskid, awssak, aws_region))
+					finishAudit(EXIT_SUCCESS)
 				} else {
 					fmt.Println("Unsupported cloud provider:", cloud_provider)
-					os.Exit(ERR_CERT_UPLOAD)
+					exitWith(ERR_CERT_UPLOAD)
 				}
 			default:
 				fmt.Println("Unexpected cert_sub_command:", cert_sub_command)
-				os.Exit(ERR_CERT_UPLOAD)
+				exitWith(ERR_CERT_UPLOAD)
 			}
 		},
 	}
@@ -407,6 +1123,7 @@ func main() {
 		Run: func(cmd *cobra.Command, args []string) {
 			pwd := utils.GetDataFromVault(DOCKER_REGISTRY_KEY)
 			login := Login{"docker", pwd}
+			redactSecrets(pwd)
 
 			builder_sub_command := args[0]
 
@@ -414,31 +1131,35 @@ func main() {
 			case "push":
 				if len(args) < 2 {
 					fmt.Println("please provide image name")
-					os.Exit(ERR_DOCKER_BUILDER)
+					exitWith(ERR_DOCKER_BUILDER)
 				}
+				startAudit(cmd, args)
 				push_repo(args[1], login)
+				finishAudit(EXIT_SUCCESS)
 
 			case "build":
 				if len(Directory) > 0 && len(Tag) > 0 && len(File) > 0 {
 					dockerCommand := fmt.Sprintf("docker build --no-cache --pull -t %s -f %s %s", Tag, File, Directory)
 					fmt.Println(fmt.Sprintf("Executing docker command: %s", dockerCommand))
-					exec_cmd(dockerCommand)
+					startAudit(cmd, args)
+					exec_mutating_cmd(dockerCommand)
 					push_repo(Tag, login)
+					finishAudit(EXIT_SUCCESS)
 				} else {
 					fmt.Println("please provide all the flags -d, -f, -t")
-					os.Exit(ERR_DOCKER_BUILDER)
+					exitWith(ERR_DOCKER_BUILDER)
 				}
 			case "pull":
 				if len(args) < 2 {
 					fmt.Println("please provide image name")
-					os.Exit(ERR_DOCKER_BUILDER)
+					exitWith(ERR_DOCKER_BUILDER)
 				}
 				repoName := utils.GetConfigString("repoPullName")
 				exec_cmd(fmt.Sprintf("docker pull %s/%s", repoName, args[1]))
 			default:
 				fmt.Println(fmt.Sprintf("applying the docker command -- docker %s", build_cmd_args(args)))
 				exec_cmd(fmt.Sprintf("docker %s", build_cmd_args(args)))
-				os.Exit(EXIT_SUCCESS)
+				exitWith(EXIT_SUCCESS)
 			}
 		},
 	}
@@ -474,22 +1195,7 @@ func main() {
 
 				defer file.Close()
 
-				awskid := utils.GetDataFromVault(AWS_KEY_ID)
-				awssak := utils.GetDataFromVault(AWS_ACCESS_KEY)
-				aws_region := utils.GetConfigString("region")
-				sess, _ := session.NewSession(&aws.Config{
-					Region:      aws.String(aws_region),
-					Credentials: credentials.NewStaticCredentials(awskid, awssak, ""),
-				},
-				)
-
-				downloader := s3manager.NewDownloader(sess)
-
-				numBytes, err := downloader.Download(file,
-					&s3.GetObjectInput{
-						Bucket: aws.String(bucket),
-						Key:    aws.String(folder + "/" + item),
-					})
+				numBytes, err := downloadFromS3(file, bucket, folder+"/"+item)
 				if err != nil {
 					utils.ExitErrorf("Unable to download item %q, %v", item, err)
 				}
@@ -498,7 +1204,7 @@ func main() {
 
 			default:
 				fmt.Println("Unsupported sub_command:", sub_command)
-				os.Exit(ERR_AWS)
+				exitWith(ERR_AWS)
 			}
 		},
 	}
@@ -531,6 +1237,7 @@ func main() {
 
 				awskid := utils.GetDataFromVault(utils.GetEnvPath(AWS_KEY_ID, env))
 				awssak := utils.GetDataFromVault(utils.GetEnvPath(AWS_ACCESS_KEY, env))
+				redactSecrets(awskid, awssak)
 
 				aws_region := utils.GetConfigString("region")
 
@@ -543,18 +1250,23 @@ func main() {
 					letsEncryptStaging = "  -e \"STAGING=true\"  "
 				}
 
-				output := exec_shell_cmd(fmt.Sprintf(" docker run  %s  -e \"DOMAIN=%s\" -e \"EMAIL=%s\" -e \"AWS_ACCESS_KEY_ID=%s\" -e \"AWS_SECRET_ACCESS_KEY=%s\" -e \"AWS_DEFAULT_REGION=%s\" -e \"TZPATH=America/Chicago\" -v %s:/etc/letsencrypt artifact-repo.service.rcsnp.rsiapps.internal:6070/rcs/letsencrypt-certbot:1.0.0", letsEncryptStaging, domain, email, awskid, awssak, aws_region, lets_encrypt_root_dir))
+				output := exec_mutating_shell_cmd(fmt.Sprintf(" docker run  %s  -e \"DOMAIN=%s\" -e \"EMAIL=%s\" -e \"AWS_ACCESS_KEY_ID=%s\" -e \"AWS_SECRET_ACCESS_KEY=%s\" -e \"AWS_DEFAULT_REGION=%s\" -e \"TZPATH=America/Chicago\" -v %s:/etc/letsencrypt artifact-repo.service.rcsnp.rsiapps.internal:6070/rcs/letsencrypt-certbot:1.0.0", letsEncryptStaging, domain, email, awskid, awssak, aws_region, lets_encrypt_root_dir))
+
+				if dryRun {
+					printDryRun("would import the certificate from %s/live/%s/ into AWS ACM in %s \n", lets_encrypt_root_dir, domain, aws_region)
+					exitWith(EXIT_SUCCESS)
+				}
 
 				if strings.Contains(output, "not yet due for renewal") {
 					fmt.Printf("\n Certificate for domain %s  not yet due for renewal. \n", domain)
-					os.Exit(utils.EXIT_SUCCESS)
+					exitWith(utils.EXIT_SUCCESS)
 				}
 
 				re := regexp.MustCompile("/etc/letsencrypt/live/(.+)/fullchain.pem")
 				matches := re.FindStringSubmatch(output)
 				if !(len(matches[1]) > 0) {
 					fmt.Printf("\n Error: Unexpected output for Certificate for domain %s  .  Output: %s \n", domain, output)
-					os.Exit(utils.ERR_CERT_UPLOAD)
+					exitWith(utils.ERR_CERT_UPLOAD)
 				}
 
 				fmt.Printf("\n  Certificate for domain %s  .  Saved at root dir: %s \n", domain, matches[1])
@@ -575,26 +1287,111 @@ func main() {
 
 				if strings.Contains(output, "CertificateArn") {
 					fmt.Printf("\n Succsessfully created or renewed certificate for domain %s !!! \n", domain)
-					os.Exit(EXIT_SUCCESS)
+					exitWith(EXIT_SUCCESS)
 				} else {
 					fmt.Printf("\n Failed to create or renew certificate for domain %s ! \n", domain)
-					os.Exit(ERR_FAILED_TO_RENEW_OR_CREATE_CERTIFICATE)
+					exitWith(ERR_FAILED_TO_RENEW_OR_CREATE_CERTIFICATE)
 				}
 
 			default:
 				fmt.Println("Unsupported sub_command:", sub_command)
-				os.Exit(ERR_AWS)
+				exitWith(ERR_AWS)
 			}
 		},
 	}
 
 	var rootCmd = &cobra.Command{Use: "cs"}
+	rootCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", false, "do the reads and checks and print what would be changed, without changing anything")
 
 	rootCmd.AddCommand(cmdQuota)
 	rootCmd.AddCommand(cmdRun)
 	rootCmd.AddCommand(cmdRunArtifactID)
+	rootCmd.AddCommand(cmdValidate)
+	rootCmd.AddCommand(cmdDrift)
+	rootCmd.AddCommand(cmdDiffEnv)
+	rootCmd.AddCommand(cmdRightsize)
+	rootCmd.AddCommand(cmdInit)
+	rootCmd.AddCommand(cmdRollback)
+	rootCmd.AddCommand(cmdScale)
+	rootCmd.AddCommand(cmdDispatch)
+	rootCmd.AddCommand(cmdPromote)
+	rootCmd.AddCommand(cmdApply)
+	rootCmd.AddCommand(cmdApprove)
+	rootCmd.AddCommand(cmdJobs)
+	rootCmd.AddCommand(cmdLock)
+	rootCmd.AddCommand(cmdHistory)
 	rootCmd.AddCommand(cmdNomad)
 
+	cmdRollback.Flags().DurationVar(&deployOptions.Timeout, "timeout", 10*time.Minute, "how long to wait for the reverted deployment to finish")
+	cmdScale.Flags().BoolVar(&deployOptions.Detach, "detach", false, "return right after the group is scaled, don't wait for the allocations")
+	cmdScale.Flags().DurationVar(&deployOptions.Timeout, "timeout", 10*time.Minute, "how long to wait for the scaled group to be placed")
+
+	cmdDispatch.Flags().StringArrayVar(&dispatchMeta, "meta", nil, "meta data of the dispatched job (key=value)")
+	cmdDispatch.Flags().BoolVar(&deployOptions.Detach, "detach", false, "return right after the job is dispatched, don't wait for the evaluation")
+	cmdDispatch.Flags().DurationVar(&deployOptions.Timeout, "timeout", 10*time.Minute, "how long to wait for the dispatched job to be placed")
+
+	cmdPromote.Flags().StringVar(&promoteFrom, "from", "", "the config profile of the environment to promote from")
+	cmdPromote.Flags().StringVar(&promoteTo, "to", "", "the config profile of the environment to promote to")
+	cmdPromote.Flags().StringVarP(&promoteFile, "file", "f", "", "the job file of the target environment, instead of the job running there")
+
+	cmdApply.Flags().StringVarP(&stackFile, "file", "f", "", "the stack file")
+	cmdApply.Flags().DurationVar(&deployOptions.Timeout, "timeout", 10*time.Minute, "how long to wait for each deployment and dependency")
+	cmdApply.Flags().DurationVar(&lockWait, "lock-wait", 5*time.Minute, "how long to wait for the deploy lock of each job")
+
+	cmdApprove.Flags().DurationVar(&approvalExpires, "expires", 24*time.Hour, "how long the approval is valid")
+	cmdApprove.Flags().StringVar(&approvalComment, "comment", "", "why the job is approved")
+
+	cmdHistory.Flags().StringVar(&historyJob, "job", "", "only show records of this job id")
+	cmdHistory.Flags().StringVar(&historyEnv, "env", "", "only show records of this env")
+	cmdHistory.Flags().StringVar(&historySince, "since", "", "only show records since a duration (24h) or a date (2019-06-01)")
+
+	cmdRunArtifactID.Flags().StringVar(&artifactTask, "task", "", "the task whose image is replaced by the artifact id")
+
+	for _, jobCmd := range []*cobra.Command{cmdRun, cmdRunArtifactID, cmdPromote} {
+		jobCmd.Flags().BoolVar(&deployOptions.Detach, "detach", false, "return right after the job is registered, don't wait for the deployment")
+		jobCmd.Flags().DurationVar(&deployOptions.Timeout, "timeout", 10*time.Minute, "how long to wait for the deployment to finish")
+		jobCmd.Flags().BoolVar(&deployOptions.AutoRollback, "auto-rollback", false, "promote healthy canaries and roll back to the previous stable version if the deployment fails")
+		jobCmd.Flags().DurationVar(&lockWait, "lock-wait", 5*time.Minute, "how long to wait for the deploy lock of the job")
+	}
+
+	for _, jobCmd := range []*cobra.Command{cmdRun, cmdRunArtifactID, cmdScale, cmdRollback, cmdPromote, cmdApply} {
+		jobCmd.Flags().StringVar(&breakGlassReason, "break-glass", "", "deploy during a freeze of the job's env, the reason is audited")
+	}
+
+	for _, jobCmd := range []*cobra.Command{cmdRun, cmdRunArtifactID, cmdValidate} {
+		jobCmd.Flags().StringArrayVar(&jobFileOptions.Vars, "var", nil, "HCL2 job file variable (key=value)")
+		jobCmd.Flags().StringArrayVar(&jobFileOptions.VarFiles, "var-file", nil, "HCL2 job file variables file")
+		jobCmd.Flags().StringVar(&jobFileOptions.Env, "env", "", "merge the job file's overlay for this env (job.<env>.yaml, job.<env>.vars)")
+		jobCmd.Flags().BoolVar(&renderJob, "render", false, "print the merged job instead of submitting it")
+	}
+
+	cmdJobs.Flags().StringArrayVar(&jobFileOptions.Vars, "var", nil, "HCL2 job file variable (key=value)")
+	cmdJobs.Flags().StringArrayVar(&jobFileOptions.VarFiles, "var-file", nil, "HCL2 job file variables file")
+	cmdJobs.Flags().StringVar(&jobFileOptions.Env, "env", "", "merge the job file's overlay for this env (job.<env>.yaml, job.<env>.vars)")
+
+	cmdDrift.Flags().StringArrayVar(&jobFileOptions.Vars, "var", nil, "HCL2 job file variable (key=value)")
+	cmdDrift.Flags().StringArrayVar(&jobFileOptions.VarFiles, "var-file", nil, "HCL2 job file variables file")
+	cmdDrift.Flags().StringVar(&jobFileOptions.Env, "env", "", "merge the job files' overlays for this env (job.<env>.yaml, job.<env>.vars)")
+
+	cmdDiffEnv.Flags().StringSliceVar(&diffProfiles, "profiles", nil, "the config profiles to compare (uat,prod)")
+	cmdDiffEnv.Flags().BoolVar(&diffShowAll, "all", false, "also show what is the same in every profile")
+
+	cmdRightsize.Flags().DurationVar(&rightsizeWindow, "window", 10*time.Minute, "how long to sample the resource usage")
+	cmdRightsize.Flags().DurationVar(&rightsizeInterval, "interval", 30*time.Second, "how often to sample the resource usage")
+	cmdRightsize.Flags().IntVar(&rightsizeHeadroom, "headroom", 20, "percent added on top of the peak usage")
+
+	cmdInit.Flags().StringVar(&initOptions.Group, "group", "", "the group of the job (${meta.group})")
+	cmdInit.Flags().StringVar(&initOptions.Env, "env", "", "the env of the job (${meta.env}), the env of the active profile by default")
+	cmdInit.Flags().StringVar(&initOptions.NodeClass, "class", "", "the node class of the job (${node.class}), the node class of the active profile by default")
+	cmdInit.Flags().StringVar(&initOptions.Image, "image", "", "the docker image of the task")
+	cmdInit.Flags().IntVar(&initOptions.Port, "port", 0, "the port the container listens on")
+	cmdInit.Flags().StringVarP(&initOutput, "output", "o", "", "the job file to write, <name>.nomad by default")
+	cmdInit.Flags().StringVar(&initTargetGroupARN, "target-group-arn", "", "map the service to this ALB target group")
+
+	cmdPromote.Flags().StringArrayVar(&jobFileOptions.Vars, "var", nil, "HCL2 job file variable (key=value)")
+	cmdPromote.Flags().StringArrayVar(&jobFileOptions.VarFiles, "var-file", nil, "HCL2 job file variables file")
+	cmdPromote.Flags().StringVar(&jobFileOptions.Env, "env", "", "merge the job file's overlay for this env (job.<env>.yaml, job.<env>.vars)")
+
 	dockerBuild.Flags().StringVarP(&Tag, "tag", "t", "", "Tag the docker image")
 	dockerBuild.Flags().StringVarP(&Directory, "directory", "d", "", "directory to run the docker")
 	dockerBuild.Flags().StringVarP(&File, "file", "f", "", "file to use to build image")
@@ -610,7 +1407,7 @@ func main() {
 
 func push_repo(image_name string, login Login) {
 	repoName := utils.GetConfigString("repoPushName")
-	exec_cmd(fmt.Sprintf("docker tag %s %s/%s", image_name, repoName, image_name))
-	exec_cmd(fmt.Sprintf("docker login -u %s -p %s %s", login.Username, login.Password, repoName))
-	exec_cmd(fmt.Sprintf("docker push %s/%s", repoName, image_name))
+	exec_mutating_cmd(fmt.Sprintf("docker tag %s %s/%s", image_name, repoName, image_name))
+	exec_mutating_cmd(fmt.Sprintf("docker login -u %s -p %s %s", login.Username, login.Password, repoName))
+	exec_mutating_cmd(fmt.Sprintf("docker push %s/%s", repoName, image_name))
 }
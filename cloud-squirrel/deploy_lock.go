@@ -0,0 +1,165 @@
+// Per-job deploy locks, so that concurrent deploys of the same job don't race on the job submission
+// and on the ALB target group sync that follows.
+// The locks are consul session locks under locks/deploy/<job id>, the value is the identity of the holder.
+// A lock left behind by a killed cs is released when its session TTL expires.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+const (
+	DEPLOY_LOCK_PATH        = "locks/deploy/"
+	DEPLOY_LOCK_SESSION_TTL = "60s"
+	ERR_DEPLOY_LOCK         = 31
+)
+
+type DeployLockHolder struct {
+	User     string    `json:"user"`
+	Hostname string    `json:"hostname"`
+	Profile  string    `json:"profile"`
+	Command  string    `json:"command"`
+	Since    time.Time `json:"since"`
+}
+
+func (h *DeployLockHolder) String() string {
+	return fmt.Sprintf("%s@%s (profile %s) since %s, command: %s", h.User, h.Hostname, h.Profile,
+		h.Since.Local().Format("2006-01-02 15:04:05"), h.Command)
+}
+
+// The deploy lock held by this cs, released by releaseDeployLock.
+var heldDeployLock *consulapi.Lock
+
+// Waits up to wait for the deploy lock of the job. Exits if the lock is still held by someone else after that.
+func acquireDeployLock(consulClient *consulapi.Client, job_id string, wait time.Duration) {
+	if err := tryAcquireDeployLock(consulClient, job_id, wait); err != nil {
+		fmt.Printf("%s \n", err)
+		exitWith(ERR_DEPLOY_LOCK)
+	}
+}
+
+func tryAcquireDeployLock(consulClient *consulapi.Client, job_id string, wait time.Duration) error {
+	key := DEPLOY_LOCK_PATH + job_id
+	holder, _ := readDeployLockHolder(consulClient, key)
+
+	if dryRun {
+		if holder != nil {
+			printDryRun("would wait up to %s for the deploy lock of job %s, held by %s \n", wait, job_id, holder)
+		} else {
+			printDryRun("would take the deploy lock %s \n", key)
+		}
+		return nil
+	}
+
+	userName, hostname := currentIdentity()
+	value, _ := json.Marshal(&DeployLockHolder{
+		User:     userName,
+		Hostname: hostname,
+		Profile:  viper.GetString("active"),
+		Command:  strings.Join(os.Args, " "),
+		Since:    time.Now().UTC(),
+	})
+
+	lock, err := consulClient.LockOpts(&consulapi.LockOptions{
+		Key:         key,
+		Value:       value,
+		SessionName: "cs deploy " + job_id,
+		SessionTTL:  DEPLOY_LOCK_SESSION_TTL,
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to create the deploy lock of job %s, Error: %s", job_id, err)
+	}
+
+	if holder != nil {
+		fmt.Printf("Waiting up to %s for the deploy lock of job %s, held by %s \n", wait, job_id, holder)
+	}
+
+	stopCh := make(chan struct{})
+	timer := time.AfterFunc(wait, func() { close(stopCh) })
+	lockCh, err := lock.Lock(stopCh)
+	timer.Stop()
+
+	if err != nil {
+		return fmt.Errorf("Unable to take the deploy lock of job %s, Error: %s", job_id, err)
+	}
+	if lockCh == nil {
+		holder, _ = readDeployLockHolder(consulClient, key)
+		return fmt.Errorf("Timed out after %s waiting for the deploy lock of job %s, held by %s", wait, job_id, holder)
+	}
+
+	heldDeployLock = lock
+	return nil
+}
+
+func releaseDeployLock() {
+	if heldDeployLock == nil {
+		return
+	}
+
+	if err := heldDeployLock.Unlock(); err != nil {
+		fmt.Printf("Unable to release the deploy lock, Error: %s \n", err)
+	}
+	heldDeployLock.Destroy()
+	heldDeployLock = nil
+}
+
+// Returns the holder of the lock, or nil if the lock is free.
+func readDeployLockHolder(consulClient *consulapi.Client, key string) (*DeployLockHolder, string) {
+	kvp, _, err := consulClient.KV().Get(key, nil)
+	if err != nil || kvp == nil || kvp.Session == "" {
+		return nil, ""
+	}
+
+	var holder DeployLockHolder
+	if err := json.Unmarshal(kvp.Value, &holder); err != nil {
+		holder.User = "unknown"
+	}
+
+	return &holder, kvp.Session
+}
+
+func listDeployLocks(consulClient *consulapi.Client) {
+	keys, _, err := consulClient.KV().Keys(DEPLOY_LOCK_PATH, "", nil)
+	if err != nil {
+		fmt.Printf("Unable to list the deploy locks, Error: %s \n", err)
+		exitWith(ERR_DEPLOY_LOCK)
+	}
+
+	for _, key := range keys {
+		if holder, _ := readDeployLockHolder(consulClient, key); holder != nil {
+			fmt.Printf("%-30s %s \n", strings.TrimPrefix(key, DEPLOY_LOCK_PATH), holder)
+		}
+	}
+}
+
+// Frees the lock of a job whose holder is stuck, by destroying the holder's session.
+func breakDeployLock(consulClient *consulapi.Client, job_id string) {
+	key := DEPLOY_LOCK_PATH + job_id
+	holder, session := readDeployLockHolder(consulClient, key)
+	if holder == nil {
+		fmt.Printf("Job %s is not locked \n", job_id)
+		return
+	}
+
+	if dryRun {
+		printDryRun("would break the deploy lock of job %s, held by %s \n", job_id, holder)
+		return
+	}
+
+	if _, err := consulClient.Session().Destroy(session, nil); err != nil {
+		fmt.Printf("Unable to break the deploy lock of job %s, Error: %s \n", job_id, err)
+		exitWith(ERR_DEPLOY_LOCK)
+	}
+	consulClient.KV().Delete(key, nil)
+
+	fmt.Printf("Broke the deploy lock of job %s, held by %s \n", job_id, holder)
+}
@@ -0,0 +1,65 @@
+// Compares a job running in the nomad clusters of several profiles (cs diff-env <job> --profiles uat,prod).
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/viper"
+
+	"./utils"
+)
+
+const (
+	ERR_DIFF_ENV = 36
+)
+
+// Prints the normalized job of every profile side by side, only the rows that differ unless showAll is set.
+func compareJobAcrossProfiles(job_id string, profiles []string, showAll bool) {
+	models := make([]JobModel, 0, len(profiles))
+
+	for _, profile := range profiles {
+		if !viper.IsSet(profile) {
+			fmt.Printf("Unknown config profile: %s \n", profile)
+			exitWith(ERR_DIFF_ENV)
+		}
+
+		runningJob, _, err := utils.GetProfileNomadClient(profile).Jobs().Info(job_id, nil)
+		if err != nil {
+			fmt.Printf("Job %s is not running in profile %s: %s \n", job_id, profile, err)
+			models = append(models, make(JobModel))
+			continue
+		}
+		models = append(models, normalizeJob(runningJob))
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(writer, "  \t%s\t%s\n", job_id, strings.Join(profiles, "\t"))
+
+	differences := 0
+	for _, key := range jobModelKeys(nil, models...) {
+		values := make([]string, 0, len(models))
+		differs := false
+		for _, model := range models {
+			values = append(values, modelValue(model[key]))
+			if model[key] != models[0][key] {
+				differs = true
+			}
+		}
+
+		marker := " "
+		if differs {
+			marker = "*"
+			differences++
+		} else if !showAll {
+			continue
+		}
+		fmt.Fprintf(writer, "%s \t%s\t%s\n", marker, key, strings.Join(values, "\t"))
+	}
+	writer.Flush()
+
+	fmt.Printf("\n%d differences between %s \n", differences, strings.Join(profiles, ", "))
+}
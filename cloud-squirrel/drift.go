@@ -0,0 +1,90 @@
+// Drift detection (cs drift <dir>): compares the job files of a directory with the jobs running in nomad.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	nomadapi "github.com/hashicorp/nomad/api"
+)
+
+const (
+	ERR_DRIFT = 35
+)
+
+var driftKinds = []string{JOB_MODEL_IMAGE, JOB_MODEL_COUNT, JOB_MODEL_CPU, JOB_MODEL_MEMORY, JOB_MODEL_CONSTRAINT, JOB_MODEL_SERVICES}
+
+var jobFileSuffixes = []string{".nomad", ".hcl", ".nomad.json"}
+
+func findJobFiles(dir string) []string {
+	jobFiles := make([]string, 0)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		for _, suffix := range jobFileSuffixes {
+			if strings.HasSuffix(path, suffix) {
+				jobFiles = append(jobFiles, path)
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("Unable to read job files from %s, Error: %s \n", dir, err)
+		exitWith(ERR_DRIFT)
+	}
+
+	return jobFiles
+}
+
+// Prints the differences between every job file of the directory and its running job. Returns whether anything drifted.
+// A job file that can't be loaded is reported and counts as drifted, the other job files are still compared.
+func detectDrift(nomadClient *nomadapi.Client, dir string, jobFileOptions *JobFileOptions) bool {
+	drifted := false
+
+	for _, jobFile := range findJobFiles(dir) {
+		path, content, _, cleanup := readJobSource(jobFile)
+		parsedFile, _, err := loadNomadJob(jobFile, path, content, jobFileOptions)
+		cleanup()
+		if err != nil {
+			fmt.Printf("%s: failed, %s \n", jobFile, err)
+			drifted = true
+			continue
+		}
+		job_id := jobID(parsedFile)
+
+		runningJob, _, err := nomadClient.Jobs().Info(job_id, nil)
+		if err != nil {
+			fmt.Printf("%s (%s): not running in nomad \n", job_id, jobFile)
+			drifted = true
+			continue
+		}
+		if runningJob.Stop != nil && *runningJob.Stop {
+			fmt.Printf("%s (%s): stopped in nomad \n", job_id, jobFile)
+			drifted = true
+			continue
+		}
+
+		diffs := diffJobModels(normalizeJob(parsedFile), normalizeJob(runningJob), driftKinds)
+		if len(diffs) == 0 {
+			fmt.Printf("%s (%s): in sync \n", job_id, jobFile)
+			continue
+		}
+
+		drifted = true
+		fmt.Printf("%s (%s): drifted \n", job_id, jobFile)
+		for _, diff := range diffs {
+			fmt.Printf("    %s: file %s, running %s \n", diff.Key, modelValue(diff.Old), modelValue(diff.New))
+		}
+	}
+
+	return drifted
+}
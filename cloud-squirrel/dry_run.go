@@ -0,0 +1,39 @@
+// Dry run mode (cs --dry-run ...): the mutating commands do all their reads and checks as usual,
+// the actions that would change something are printed instead of executed.
+// Secrets read from vault are redacted from the printed actions.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	DRY_RUN_REDACTED = "<redacted>"
+)
+
+var dryRun bool
+
+var dryRunSecrets = make([]string, 0)
+
+// Remembers secrets so that they never show up in the printed actions.
+func redactSecrets(secrets ...string) {
+	for _, secret := range secrets {
+		if secret != "" {
+			dryRunSecrets = append(dryRunSecrets, secret)
+		}
+	}
+}
+
+func redact(text string) string {
+	for _, secret := range dryRunSecrets {
+		text = strings.Replace(text, secret, DRY_RUN_REDACTED, -1)
+	}
+
+	return text
+}
+
+func printDryRun(format string, a ...interface{}) {
+	fmt.Print(redact(fmt.Sprintf("[dry-run] "+format, a...)))
+}
@@ -0,0 +1,102 @@
+// Guards against deploying a job into the wrong environment: the ${meta.env} constraint of the job,
+// the env of the active profile and the region/datacenter of the profile's nomad cluster must agree.
+// The mapping is configured per profile env in cs.properties (lists are separated by spaces), for example:
+//
+//	env_mapping.rcsprod.job_envs=rcsprod
+//	env_mapping.rcsprod.nomad_regions=us-east
+//	env_mapping.rcsprod.nomad_datacenters=prod-dc1 prod-dc2
+//
+// Without job_envs the job env must be the profile env. At least one of nomad_regions/nomad_datacenters
+// is required, nothing is deployed to a cluster whose identity can't be checked.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+
+	nomadapi "github.com/hashicorp/nomad/api"
+
+	"./utils"
+)
+
+const (
+	ERR_ENV_MISMATCH = 33
+)
+
+func checkJobEnvironment(parsedFile *nomadapi.Job) {
+	profile := viper.GetString("active")
+	profileEnv := utils.GetConfigString("env")
+	jobEnv := utils.GetConstraintValue(parsedFile.Constraints, utils.NOMAD_ENV_CONSTRAINT)
+	mapping := "env_mapping." + profileEnv
+
+	jobEnvs := viper.GetStringSlice(mapping + ".job_envs")
+	if len(jobEnvs) == 0 {
+		jobEnvs = []string{profileEnv}
+	}
+	if !containsString(jobEnvs, jobEnv) {
+		fmt.Printf("Job %s is for env %s, but profile %s (env %s) only deploys jobs of env %s. Will not start job. \n",
+			jobID(parsedFile), jobEnv, profile, profileEnv, strings.Join(jobEnvs, ", "))
+		exitWith(ERR_ENV_MISMATCH)
+	}
+
+	regions := viper.GetStringSlice(mapping + ".nomad_regions")
+	datacenters := viper.GetStringSlice(mapping + ".nomad_datacenters")
+	if len(regions) == 0 && len(datacenters) == 0 {
+		fmt.Printf("No nomad_regions/nomad_datacenters in env_mapping.%s, unable to check the identity of the nomad cluster of profile %s. Will not start job. \n",
+			profileEnv, profile)
+		printEnvMappingHint(profileEnv)
+		exitWith(ERR_ENV_MISMATCH)
+	}
+
+	agent := utils.GetNomadClient().Agent()
+	if len(regions) > 0 {
+		region, err := agent.Region()
+		checkClusterIdentity("region", region, err, regions, profile, profileEnv)
+	}
+	if len(datacenters) > 0 {
+		datacenter, err := agent.Datacenter()
+		checkClusterIdentity("datacenter", datacenter, err, datacenters, profile, profileEnv)
+	}
+}
+
+// Prints the properties to add for the env, with the region and datacenter of the profile's nomad agent when it answers.
+func printEnvMappingHint(profileEnv string) {
+	region, datacenter := "<region>", "<datacenter>"
+	agent := utils.GetNomadClient().Agent()
+	if actual, err := agent.Region(); err == nil {
+		region = actual
+	}
+	if actual, err := agent.Datacenter(); err == nil {
+		datacenter = actual
+	}
+
+	fmt.Printf("Add one or both of these to %s: \n", viper.ConfigFileUsed())
+	fmt.Printf("  env_mapping.%s.nomad_regions=%s \n", profileEnv, region)
+	fmt.Printf("  env_mapping.%s.nomad_datacenters=%s \n", profileEnv, datacenter)
+}
+
+func checkClusterIdentity(kind string, actual string, err error, expected []string, profile string, profileEnv string) {
+	if err != nil {
+		fmt.Printf("Unable to get the %s of the nomad agent of profile %s, Error: %s \n", kind, profile, err)
+		exitWith(ERR_ENV_MISMATCH)
+	}
+
+	if !containsString(expected, actual) {
+		fmt.Printf("The nomad cluster of profile %s is in %s %s, but env %s is mapped to %s. Will not start job. \n",
+			profile, kind, actual, profileEnv, strings.Join(expected, ", "))
+		exitWith(ERR_ENV_MISMATCH)
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
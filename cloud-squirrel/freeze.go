@@ -0,0 +1,104 @@
+// Deployment freeze windows (exam seasons, release weekends).
+// The freezes of an env are stored in consul KV under freezes/<env>/<name>, the env and the groups are the
+// ${meta.env} and ${meta.group} constraint values of the jobs, the same as in the quota keys:
+//
+//	{"start": "2019-06-01T00:00:00Z", "end": "2019-06-15T00:00:00Z", "reason": "exam season", "groups": ["scoring"]}
+//
+// A freeze without groups applies to every group of the env.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	nomadapi "github.com/hashicorp/nomad/api"
+
+	"./utils"
+)
+
+const (
+	FREEZE_CONSUL_PATH = "freezes/"
+	ERR_DEPLOY_FREEZE  = 32
+)
+
+type FreezeWindow struct {
+	Name   string    `json:"-"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Reason string    `json:"reason"`
+	Groups []string  `json:"groups"`
+}
+
+func (f *FreezeWindow) appliesTo(group string, at time.Time) bool {
+	if at.Before(f.Start) || !at.Before(f.End) {
+		return false
+	}
+
+	return len(f.Groups) == 0 || containsString(f.Groups, group)
+}
+
+// Returns the first of the groups the freeze applies to.
+func (f *FreezeWindow) appliesToAny(groups []string, at time.Time) (string, bool) {
+	for _, group := range groups {
+		if f.appliesTo(strings.TrimSpace(group), at) {
+			return strings.TrimSpace(group), true
+		}
+	}
+
+	return "", false
+}
+
+// Refuses to change the job while a freeze of its env and one of its groups is on, unless a break-glass reason is given.
+// The ${meta.group} constraint of a set_contains job is a comma separated set of groups.
+func checkDeployFreeze(consulClient *consulapi.Client, parsedFile *nomadapi.Job, breakGlassReason string) {
+	env := utils.GetConstraintValue(parsedFile.Constraints, utils.NOMAD_ENV_CONSTRAINT)
+	groups := strings.Split(utils.GetConstraintValue(parsedFile.Constraints, utils.NOMAD_GROUP_CONSTRAINT), ",")
+
+	now := time.Now()
+	for _, freeze := range readFreezeWindows(consulClient, env) {
+		group, frozen := freeze.appliesToAny(groups, now)
+		if !frozen {
+			continue
+		}
+
+		if breakGlassReason == "" {
+			fmt.Printf("Deployments of %s--%s are frozen until %s by freeze %s: %s \n", env, group,
+				freeze.End.Local().Format("2006-01-02 15:04"), freeze.Name, freeze.Reason)
+			fmt.Printf("Use --break-glass \"reason\" to deploy anyway, the use is audited. \n")
+			exitWith(ERR_DEPLOY_FREEZE)
+		}
+
+		fmt.Printf("Breaking freeze %s (%s) of %s--%s: %s \n", freeze.Name, freeze.Reason, env, group, breakGlassReason)
+		auditBreakGlass(freeze.Name, breakGlassReason)
+	}
+}
+
+func readFreezeWindows(consulClient *consulapi.Client, env string) []*FreezeWindow {
+	kvps, _, err := consulClient.KV().List(FREEZE_CONSUL_PATH+env+"/", nil)
+	if err != nil {
+		fmt.Printf("Unable to read the freezes of env %s from consul, Error: %s \n", env, err)
+		exitWith(ERR_DEPLOY_FREEZE)
+	}
+
+	freezes := make([]*FreezeWindow, 0, len(kvps))
+	for _, kvp := range kvps {
+		if strings.HasSuffix(kvp.Key, "/") {
+			continue
+		}
+
+		var freeze FreezeWindow
+		if err := json.Unmarshal(kvp.Value, &freeze); err != nil {
+			// a freeze that can't be read must not be ignored
+			fmt.Printf("Malformed freeze %s, Error: %s \n", kvp.Key, err)
+			exitWith(ERR_DEPLOY_FREEZE)
+		}
+		freeze.Name = strings.TrimPrefix(kvp.Key, FREEZE_CONSUL_PATH+env+"/")
+		freezes = append(freezes, &freeze)
+	}
+
+	return freezes
+}
@@ -0,0 +1,216 @@
+// Scaffolding of new job files (cs init) with the constraints and service tags that cs and the ALB sync expect.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/spf13/viper"
+
+	consulapi "github.com/hashicorp/consul/api"
+	nomadapi "github.com/hashicorp/nomad/api"
+
+	"./utils"
+)
+
+const (
+	ERR_INIT = 39
+
+	TARGET_GROUPS_CONSUL_PATH = "service/apps/targetgroups/"
+)
+
+type JobScaffold struct {
+	Name       string
+	Group      string
+	Env        string
+	NodeClass  string
+	Image      string
+	Port       int
+	Datacenter string
+	CPU        int
+	Memory     int
+}
+
+// The service is tagged "http", the ALB target group sync only registers the instances of services with that tag.
+var jobScaffoldTemplate = template.Must(template.New("job").Parse(`job "{{.Name}}" {
+
+  constraint {
+    attribute = "${meta.group}"
+    operator  = "set_contains"
+    value     = "{{.Group}}"
+  }
+
+  constraint {
+    attribute = "${meta.env}"
+    operator  = "="
+    value     = "{{.Env}}"
+  }
+
+  constraint {
+    attribute = "${node.class}"
+    operator  = "set_contains"
+    value     = "{{.NodeClass}}"
+  }
+
+  datacenters = ["{{.Datacenter}}"]
+
+  group "{{.Name}}" {
+    count = 1
+
+    restart {
+      attempts = 3
+      interval = "10m"
+      delay    = "25s"
+      mode     = "delay"
+    }
+
+    task "{{.Name}}" {
+      driver = "docker"
+
+      config {
+        image = "{{.Image}}"
+        port_map {
+          http = {{.Port}}
+        }
+      }
+
+      logs {
+        max_files     = 10
+        max_file_size = 25
+      }
+
+      service {
+        name = "{{.Name}}"
+        port = "http"
+        tags = ["http"]
+
+        check {
+          type     = "tcp"
+          interval = "10s"
+          timeout  = "2s"
+        }
+      }
+
+      resources {
+        cpu    = {{.CPU}}
+        memory = {{.Memory}}
+        network {
+          port "http" {}
+        }
+      }
+    }
+  }
+}
+`))
+
+// Fills in what wasn't given from the active profile: its env and its node class. The datacenter is the first
+// nomad datacenter of the env's mapping, cpu/memory are the defaults of the node class.
+func newJobScaffold(name string, group string, env string, nodeClass string, image string, port int) *JobScaffold {
+	if env == "" {
+		env = utils.GetConfigString("env")
+	}
+	if nodeClass == "" {
+		nodeClass = utils.GetConfigString("node_class")
+	}
+
+	datacenter := "dc1"
+	if datacenters := viper.GetStringSlice("env_mapping." + env + ".nomad_datacenters"); len(datacenters) > 0 {
+		datacenter = datacenters[0]
+	}
+
+	return &JobScaffold{
+		Name:       name,
+		Group:      group,
+		Env:        env,
+		NodeClass:  nodeClass,
+		Image:      image,
+		Port:       port,
+		Datacenter: datacenter,
+		CPU:        defaultResource(nodeClass, "cpu", NOMAD_DEFAULT_CPU),
+		Memory:     defaultResource(nodeClass, "memory", NOMAD_DEFAULT_MEMORY),
+	}
+}
+
+// The values are written into HCL strings as they are, so anything HCL would read as the end of the string,
+// an escape or an interpolation is refused.
+func renderJobScaffold(scaffold *JobScaffold) []byte {
+	for _, field := range []struct{ name, value string }{
+		{"name", scaffold.Name}, {"group", scaffold.Group}, {"env", scaffold.Env}, {"class", scaffold.NodeClass},
+		{"image", scaffold.Image}, {"datacenter", scaffold.Datacenter},
+	} {
+		if strings.ContainsAny(field.value, "\"\\\n") || strings.Contains(field.value, "${") || strings.Contains(field.value, "%{") {
+			fmt.Printf("Invalid %s %q, it can't contain quotes, backslashes, newlines, ${ or %%{ \n", field.name, field.value)
+			exitWith(ERR_INIT)
+		}
+	}
+
+	var content bytes.Buffer
+	if err := jobScaffoldTemplate.Execute(&content, scaffold); err != nil {
+		fmt.Printf("Unable to render job %s, Error: %s \n", scaffold.Name, err)
+		exitWith(ERR_INIT)
+	}
+
+	return content.Bytes()
+}
+
+// Writes the job file after checking that the generated job passes every check of cs run: constraints, env, static ports, images and quotas.
+func initJobFile(scaffold *JobScaffold, jobFile string, isValidNodeClass map[string]bool, consulAddress string, consulClient *consulapi.Client) *nomadapi.Job {
+	if _, err := os.Stat(jobFile); err == nil {
+		fmt.Printf("Job file %s already exists \n", jobFile)
+		exitWith(ERR_INIT)
+	}
+
+	content := renderJobScaffold(scaffold)
+	path, _ := filepath.Abs(jobFile)
+	parsedFile, err := parseNomadJob(path, content, nil, nil)
+	if err != nil {
+		fmt.Printf("Unable to parse the generated job %s, Error: %s \n", scaffold.Name, err)
+		exitWith(ERR_INIT)
+	}
+
+	checkJobConstraints(parsedFile, isValidNodeClass)
+	checkJobEnvironment(parsedFile)
+	checkStaticPorts(parsedFile)
+	checkJobImages(parsedFile)
+	checkQuotaUsage("cpu", parsedFile, consulAddress, consulClient)
+	checkQuotaUsage("memory", parsedFile, consulAddress, consulClient)
+
+	if dryRun {
+		printDryRun("would write job file %s: \n%s \n", jobFile, content)
+		return parsedFile
+	}
+
+	if err := ioutil.WriteFile(jobFile, content, 0644); err != nil {
+		fmt.Printf("Unable to write job file %s, Error: %s \n", jobFile, err)
+		exitWith(ERR_INIT)
+	}
+	fmt.Printf("Wrote job file %s \n", jobFile)
+
+	return parsedFile
+}
+
+// Maps the service to its ALB target group, the mapping the ALB sync after cs run reads.
+func registerTargetGroup(consulClient *consulapi.Client, serviceName string, targetGroupARN string) {
+	if AWSRegion(targetGroupARN) == "" {
+		fmt.Printf("Malformed target group ARN: %s \n", targetGroupARN)
+		exitWith(ERR_INIT)
+	}
+
+	key := TARGET_GROUPS_CONSUL_PATH + serviceName
+	if dryRun {
+		printDryRun("would put %s = %s \n", key, targetGroupARN)
+		return
+	}
+
+	if _, err := consulClient.KV().Put(&consulapi.KVPair{Key: key, Value: []byte(targetGroupARN)}, nil); err != nil {
+		fmt.Printf("Unable to register target group of service %s, Error: %s \n", serviceName, err)
+		exitWith(ERR_INIT)
+	}
+	fmt.Printf("Registered target group %s for service %s \n", targetGroupARN, serviceName)
+}
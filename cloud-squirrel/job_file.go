@@ -0,0 +1,224 @@
+// Loading and rendering of nomad job files.
+// Supports HCL1, HCL2 (with variables) and JSON job specs.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/nomad/jobspec"
+	"github.com/hashicorp/nomad/jobspec2"
+
+	nomadapi "github.com/hashicorp/nomad/api"
+)
+
+const (
+	ERR_RENDER_JOB_FILE = 14
+	ERR_OPEN_JOB_FILE   = 41
+	ERR_PARSE_JOB_FILE  = 42
+)
+
+// Input variables for HCL2 job files (-var and -var-file) and the env overlay to merge (--env).
+type JobFileOptions struct {
+	Vars     []string
+	VarFiles []string
+	Env      string
+}
+
+// The JSON document accepted by "nomad job run -json" and printed by "nomad job inspect".
+type jobPayload struct {
+	Job *nomadapi.Job
+}
+
+func parseNomadJobFile(job_file string, jobFileOptions *JobFileOptions) (string, *nomadapi.Job) {
+	location, parsedFile, _, _ := readNomadJobFile(job_file, jobFileOptions)
+
+	return location, parsedFile
+}
+
+// Also returns the content hash and the pinned source of the job file, for the audit records of jobs that are
+// loaded before their audit record is started (cs apply).
+func readNomadJobFile(job_file string, jobFileOptions *JobFileOptions) (string, *nomadapi.Job, string, string) {
+	if jobFileOptions.Env != "" && !jobSourceHasOverlays(job_file) {
+		fmt.Printf("--env is not supported for job file %s, only local and git job files have their overlays next to them. \n", job_file)
+		fmt.Printf("Render the job with its overlay and push it to the job registry instead: cs jobs push --env %s <job file> \n", jobFileOptions.Env)
+		exitWith(ERR_JOB_OVERLAY)
+	}
+
+	path, content, source, cleanup := readJobSource(job_file)
+	defer cleanup()
+
+	fileHash := contentHash(content)
+	auditJobFile(fileHash, source)
+
+	parsedFile, exitCode, err := loadNomadJob(job_file, path, content, jobFileOptions)
+	if err != nil {
+		fmt.Printf("%s \n", err)
+		exitWith(exitCode)
+	}
+
+	if source != "" {
+		return source, parsedFile, fileHash, source
+	}
+
+	return path, parsedFile, fileHash, source
+}
+
+// Parses the job file with its placeholders, variables and env overlay. Returns the exit code for the error,
+// so commands that go through many job files (cs drift) can report a broken one and go on.
+func loadNomadJob(job_file string, path string, content []byte, jobFileOptions *JobFileOptions) (*nomadapi.Job, int, error) {
+	content, placeholders := tokenizeJobPlaceholders(content)
+
+	overlayFile := ""
+	varFiles := jobFileOptions.VarFiles
+	if jobFileOptions.Env != "" {
+		var envVarFile string
+		overlayFile, envVarFile = findJobOverlayFiles(path, jobFileOptions.Env)
+		if overlayFile == "" && envVarFile == "" {
+			return nil, ERR_JOB_OVERLAY, fmt.Errorf("No overlay for env %s found next to job file: %s", jobFileOptions.Env, job_file)
+		}
+		if envVarFile != "" {
+			varFiles = append([]string{envVarFile}, varFiles...)
+		}
+	}
+
+	parsedFile, err := parseNomadJob(path, content, jobFileOptions.Vars, varFiles)
+	if err != nil {
+		return nil, ERR_PARSE_JOB_FILE, fmt.Errorf("Unable to parse nomad job file: %s, Error:%s", job_file, err)
+	}
+
+	if err := resolveJobPlaceholders(parsedFile, placeholders); err != nil {
+		return nil, ERR_JOB_PLACEHOLDER, fmt.Errorf("Unable to resolve placeholder in nomad job file: %s, Error: %s", job_file, err)
+	}
+
+	if overlayFile != "" {
+		overlay, err := readJobOverlay(overlayFile)
+		if err == nil {
+			err = applyJobOverlay(parsedFile, overlay)
+		}
+		if err != nil {
+			return nil, ERR_JOB_OVERLAY, fmt.Errorf("Unable to merge job overlay file: %s, Error: %s", overlayFile, err)
+		}
+	}
+
+	applyDefaultResources(parsedFile)
+
+	return parsedFile, EXIT_SUCCESS, nil
+}
+
+func parseNomadJob(path string, content []byte, vars []string, varFiles []string) (*nomadapi.Job, error) {
+	if isJSONJob(content) {
+		return parseJSONJob(content)
+	}
+
+	hasVars := len(vars) > 0 || len(varFiles) > 0
+
+	job, hcl2Err := jobspec2.ParseWithConfig(&jobspec2.ParseConfig{
+		Path:     path,
+		BaseDir:  filepath.Dir(path),
+		Body:     content,
+		AllowFS:  true,
+		ArgVars:  vars,
+		VarFiles: varFiles,
+		Envs:     os.Environ(),
+		Strict:   true,
+	})
+	if hcl2Err == nil {
+		return job, nil
+	}
+
+	// variables are an HCL2 feature, so there is nothing to fall back to
+	if hasVars {
+		return nil, hcl2Err
+	}
+
+	job, hcl1Err := jobspec.Parse(bytes.NewReader(content))
+	if hcl1Err != nil {
+		return nil, fmt.Errorf("not a valid HCL2 job (%s) nor a valid HCL1 job (%s)", hcl2Err, hcl1Err)
+	}
+
+	return job, nil
+}
+
+func isJSONJob(content []byte) bool {
+	trimmed := bytes.TrimSpace(content)
+
+	return len(trimmed) > 0 && trimmed[0] == '{' && json.Valid(trimmed)
+}
+
+// Accepts both the wrapped {"Job": {...}} payload and a bare job as returned by the nomad HTTP API.
+func parseJSONJob(content []byte) (*nomadapi.Job, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(content, &fields); err != nil {
+		return nil, err
+	}
+
+	if _, ok := fields["Job"]; ok {
+		var payload jobPayload
+		if err := json.Unmarshal(content, &payload); err != nil {
+			return nil, err
+		}
+		if payload.Job == nil {
+			return nil, fmt.Errorf("empty Job in JSON payload")
+		}
+		if err := checkJSONJobGroups(payload.Job); err != nil {
+			return nil, err
+		}
+		return payload.Job, nil
+	}
+
+	var job nomadapi.Job
+	if err := json.Unmarshal(content, &job); err != nil {
+		return nil, err
+	}
+	if job.ID == nil && job.Name == nil {
+		return nil, fmt.Errorf("JSON payload has neither a Job nor a job ID")
+	}
+
+	if err := checkJSONJobGroups(&job); err != nil {
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+// The HCL parsers name every group and task, a JSON job has to name them itself.
+func checkJSONJobGroups(job *nomadapi.Job) error {
+	for i, taskGroup := range job.TaskGroups {
+		if taskGroup == nil || taskGroup.Name == nil || *taskGroup.Name == "" {
+			return fmt.Errorf("task group %d of the JSON job has no Name", i)
+		}
+		for j, task := range taskGroup.Tasks {
+			if task == nil || task.Name == "" {
+				return fmt.Errorf("task %d of task group %s of the JSON job has no Name", j, *taskGroup.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+func renderNomadJob(parsedFile *nomadapi.Job) []byte {
+	rendered, err := json.MarshalIndent(jobPayload{Job: parsedFile}, "", "  ")
+	if err != nil {
+		fmt.Printf("Unable to render nomad job: %s, Error:%s \n", jobID(parsedFile), err)
+		exitWith(ERR_RENDER_JOB_FILE)
+	}
+
+	return rendered
+}
+
+func jobID(parsedFile *nomadapi.Job) string {
+	if parsedFile.ID != nil {
+		return *parsedFile.ID
+	}
+	if parsedFile.Name != nil {
+		return *parsedFile.Name
+	}
+
+	return ""
+}
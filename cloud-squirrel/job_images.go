@@ -0,0 +1,152 @@
+// Docker image handling for parsed nomad jobs.
+// Used by run-artifact-id to point tasks to a specific version of their Docker artifact.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	nomadapi "github.com/hashicorp/nomad/api"
+)
+
+const (
+	ERR_ARTIFACT_ID = 16
+)
+
+// A docker task of a job and the image it runs.
+type TaskImage struct {
+	Group string
+	Task  string
+	Image string
+}
+
+func dockerTaskImages(parsedFile *nomadapi.Job) []TaskImage {
+	taskImages := make([]TaskImage, 0)
+
+	for _, taskGroup := range parsedFile.TaskGroups {
+		for _, task := range taskGroup.Tasks {
+			if task.Driver != "docker" {
+				continue
+			}
+
+			image, _ := task.Config["image"].(string)
+			taskImages = append(taskImages, TaskImage{
+				Group: *taskGroup.Name,
+				Task:  task.Name,
+				Image: image,
+			})
+		}
+	}
+
+	return taskImages
+}
+
+// Parses the artifact id argument of run-artifact-id.
+// The argument is either a single artifact id, applied to the task given by --task (or to the only docker task of the job),
+// or a comma separated list of task=artifact_id pairs.
+func parseArtifactIds(artifactArg string, task string) (map[string]string, error) {
+	artifactIds := make(map[string]string)
+
+	if !strings.Contains(artifactArg, "=") {
+		artifactIds[task] = artifactArg
+		return artifactIds, nil
+	}
+
+	if task != "" {
+		return nil, fmt.Errorf("--task can't be combined with task=artifact_id pairs")
+	}
+
+	for _, pair := range strings.Split(artifactArg, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("malformed task=artifact_id pair: %q", pair)
+		}
+		if _, ok := artifactIds[parts[0]]; ok {
+			return nil, fmt.Errorf("more than one artifact id for task %q", parts[0])
+		}
+		artifactIds[parts[0]] = parts[1]
+	}
+
+	return artifactIds, nil
+}
+
+// Sets the docker image of the tasks in the job model. An empty task name stands for the only docker task of the job.
+func applyArtifactIds(parsedFile *nomadapi.Job, artifactIds map[string]string) error {
+	taskImages := dockerTaskImages(parsedFile)
+	if len(taskImages) == 0 {
+		return fmt.Errorf("job %s has no docker tasks", jobID(parsedFile))
+	}
+
+	if artifactId, ok := artifactIds[""]; ok {
+		if len(taskImages) > 1 {
+			return fmt.Errorf("job %s has %d docker tasks (%s), use --task or task=artifact_id to pick one",
+				jobID(parsedFile), len(taskImages), strings.Join(taskNames(taskImages), ", "))
+		}
+		delete(artifactIds, "")
+		artifactIds[taskImages[0].Task] = artifactId
+	}
+
+	for taskName, artifactId := range artifactIds {
+		found := false
+		for _, taskGroup := range parsedFile.TaskGroups {
+			for _, task := range taskGroup.Tasks {
+				if task.Name != taskName || task.Driver != "docker" {
+					continue
+				}
+
+				currentImage, _ := task.Config["image"].(string)
+				task.Config["image"] = replaceImageRepository(currentImage, artifactId)
+				found = true
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("no docker task %q in job %s, docker tasks are: %s",
+				taskName, jobID(parsedFile), strings.Join(taskNames(taskImages), ", "))
+		}
+	}
+
+	return nil
+}
+
+// Replaces the repository and tag of a docker image and keeps its registry, unless the artifact id has its own registry.
+// artifact-repo.rcs.rsiapps.io:6070/rcs/envoy:1.0.6 + rcs/envoy:1.0.7 -> artifact-repo.rcs.rsiapps.io:6070/rcs/envoy:1.0.7
+func replaceImageRepository(currentImage string, artifactId string) string {
+	if imageRegistry(artifactId) != "" {
+		return artifactId
+	}
+
+	registry := imageRegistry(currentImage)
+	if registry == "" {
+		return artifactId
+	}
+
+	return registry + "/" + artifactId
+}
+
+// Returns the registry host of a docker image reference, or "" for images from the default registry.
+func imageRegistry(image string) string {
+	parts := strings.SplitN(image, "/", 2)
+	if len(parts) < 2 {
+		return ""
+	}
+
+	host := parts[0]
+	if strings.ContainsAny(host, ".:") || host == "localhost" {
+		return host
+	}
+
+	return ""
+}
+
+func taskNames(taskImages []TaskImage) []string {
+	names := make([]string, 0, len(taskImages))
+	for _, taskImage := range taskImages {
+		names = append(names, taskImage.Task)
+	}
+	sort.Strings(names)
+
+	return names
+}
@@ -0,0 +1,145 @@
+// A flat, normalized view of a nomad job, used to compare job files with running jobs and jobs between environments.
+// Both sides are canonicalized first, so defaults nomad fills in (count, resources, ...) don't show up as differences.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	nomadapi "github.com/hashicorp/nomad/api"
+)
+
+const (
+	JOB_MODEL_IMAGE      = "image"
+	JOB_MODEL_COUNT      = "count"
+	JOB_MODEL_CPU        = "cpu"
+	JOB_MODEL_MEMORY     = "memory"
+	JOB_MODEL_CONSTRAINT = "constraint"
+	JOB_MODEL_SERVICES   = "services"
+	JOB_MODEL_ENV        = "env"
+)
+
+// Scope is "job", "group <group>" or "task <group>/<task>", Name is set for constraints and env vars.
+type JobModelKey struct {
+	Scope string
+	Kind  string
+	Name  string
+}
+
+func (k JobModelKey) String() string {
+	return strings.TrimSpace(k.Scope + " " + k.Kind + " " + k.Name)
+}
+
+type JobModel map[JobModelKey]string
+
+type JobModelDiff struct {
+	Key JobModelKey
+	Old string
+	New string
+}
+
+func normalizeJob(job *nomadapi.Job) JobModel {
+	job.Canonicalize()
+	model := make(JobModel)
+
+	addConstraints(model, "job", job.Constraints)
+
+	for _, taskGroup := range job.TaskGroups {
+		groupScope := "group " + *taskGroup.Name
+		model[JobModelKey{groupScope, JOB_MODEL_COUNT, ""}] = fmt.Sprintf("%d", *taskGroup.Count)
+		addConstraints(model, groupScope, taskGroup.Constraints)
+		addServices(model, groupScope, taskGroup.Services)
+
+		for _, task := range taskGroup.Tasks {
+			taskScope := "task " + *taskGroup.Name + "/" + task.Name
+			if image, ok := task.Config["image"].(string); ok {
+				model[JobModelKey{taskScope, JOB_MODEL_IMAGE, ""}] = image
+			}
+			if task.Resources != nil {
+				if task.Resources.CPU != nil {
+					model[JobModelKey{taskScope, JOB_MODEL_CPU, ""}] = fmt.Sprintf("%d", *task.Resources.CPU)
+				}
+				if task.Resources.MemoryMB != nil {
+					model[JobModelKey{taskScope, JOB_MODEL_MEMORY, ""}] = fmt.Sprintf("%d", *task.Resources.MemoryMB)
+				}
+			}
+			addConstraints(model, taskScope, task.Constraints)
+			addServices(model, taskScope, task.Services)
+			for name, value := range task.Env {
+				model[JobModelKey{taskScope, JOB_MODEL_ENV, name}] = value
+			}
+		}
+	}
+
+	return model
+}
+
+func addConstraints(model JobModel, scope string, constraints []*nomadapi.Constraint) {
+	values := make(map[string][]string)
+	for _, constraint := range constraints {
+		values[constraint.LTarget] = append(values[constraint.LTarget], strings.TrimSpace(constraint.Operand+" "+constraint.RTarget))
+	}
+
+	for lTarget, constraintValues := range values {
+		sort.Strings(constraintValues)
+		model[JobModelKey{scope, JOB_MODEL_CONSTRAINT, lTarget}] = strings.Join(constraintValues, ", ")
+	}
+}
+
+func addServices(model JobModel, scope string, services []*nomadapi.Service) {
+	if len(services) == 0 {
+		return
+	}
+
+	names := make([]string, 0, len(services))
+	for _, service := range services {
+		names = append(names, service.Name)
+	}
+	sort.Strings(names)
+
+	model[JobModelKey{scope, JOB_MODEL_SERVICES, ""}] = strings.Join(names, ", ")
+}
+
+// The sorted keys of all the models, only of the given kinds (all kinds without kinds).
+func jobModelKeys(kinds []string, models ...JobModel) []JobModelKey {
+	seen := make(map[JobModelKey]bool)
+	keys := make([]JobModelKey, 0)
+
+	for _, model := range models {
+		for key := range model {
+			if seen[key] || (len(kinds) > 0 && !containsString(kinds, key.Kind)) {
+				continue
+			}
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].String() < keys[j].String()
+	})
+
+	return keys
+}
+
+func diffJobModels(old JobModel, new JobModel, kinds []string) []JobModelDiff {
+	diffs := make([]JobModelDiff, 0)
+
+	for _, key := range jobModelKeys(kinds, old, new) {
+		if old[key] != new[key] {
+			diffs = append(diffs, JobModelDiff{Key: key, Old: old[key], New: new[key]})
+		}
+	}
+
+	return diffs
+}
+
+func modelValue(value string) string {
+	if value == "" {
+		return "(none)"
+	}
+
+	return value
+}
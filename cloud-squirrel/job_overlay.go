@@ -0,0 +1,203 @@
+// Per environment overlays for nomad job files.
+// A base job file (base.nomad) is merged with base.<env>.yaml and/or base.<env>.vars
+// so that environments don't need near-identical copies of the same job file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	nomadapi "github.com/hashicorp/nomad/api"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	ERR_JOB_OVERLAY = 15
+)
+
+// Example base.uat.yaml:
+//
+//	constraints:
+//	  "${meta.env}": rcscoreuat
+//	  "${node.class}": uat
+//	groups:
+//	  scoring:
+//	    count: 2
+//	    tasks:
+//	      scoring:
+//	        resources:
+//	          cpu: 500
+//	          memory: 1024
+//	        env:
+//	          LOG_LEVEL: info
+type JobOverlay struct {
+	Datacenters []string                `yaml:"datacenters"`
+	Constraints map[string]string       `yaml:"constraints"`
+	Meta        map[string]string       `yaml:"meta"`
+	Groups      map[string]GroupOverlay `yaml:"groups"`
+}
+
+type GroupOverlay struct {
+	Count       *int                   `yaml:"count"`
+	Constraints map[string]string      `yaml:"constraints"`
+	Meta        map[string]string      `yaml:"meta"`
+	Tasks       map[string]TaskOverlay `yaml:"tasks"`
+}
+
+type TaskOverlay struct {
+	Resources *ResourcesOverlay `yaml:"resources"`
+	Env       map[string]string `yaml:"env"`
+	Meta      map[string]string `yaml:"meta"`
+}
+
+type ResourcesOverlay struct {
+	CPU      *int `yaml:"cpu"`
+	MemoryMB *int `yaml:"memory"`
+}
+
+// Returns the overlay yaml file and the HCL2 var file of the given env for a base job file, if they exist.
+func findJobOverlayFiles(path string, env string) (string, string) {
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+
+	overlayFile := ""
+	for _, ext := range []string{".yaml", ".yml"} {
+		candidate := fmt.Sprintf("%s.%s%s", base, env, ext)
+		if fileExists(candidate) {
+			overlayFile = candidate
+			break
+		}
+	}
+
+	varFile := ""
+	if candidate := fmt.Sprintf("%s.%s.vars", base, env); fileExists(candidate) {
+		varFile = candidate
+	}
+
+	return overlayFile, varFile
+}
+
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+
+	return err == nil && !info.IsDir()
+}
+
+func readJobOverlay(overlayFile string) (*JobOverlay, error) {
+	content, err := ioutil.ReadFile(overlayFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var overlay JobOverlay
+	if err := yaml.UnmarshalStrict(content, &overlay); err != nil {
+		return nil, err
+	}
+
+	return &overlay, nil
+}
+
+func applyJobOverlay(parsedFile *nomadapi.Job, overlay *JobOverlay) error {
+	if len(overlay.Datacenters) > 0 {
+		parsedFile.Datacenters = overlay.Datacenters
+	}
+
+	parsedFile.Constraints = overlayConstraints(parsedFile.Constraints, overlay.Constraints)
+	parsedFile.Meta = overlayMeta(parsedFile.Meta, overlay.Meta)
+
+	for groupName, groupOverlay := range overlay.Groups {
+		taskGroup := findTaskGroup(parsedFile, groupName)
+		if taskGroup == nil {
+			return fmt.Errorf("group %q from overlay not found in job %s", groupName, jobID(parsedFile))
+		}
+
+		if groupOverlay.Count != nil {
+			count := *groupOverlay.Count
+			taskGroup.Count = &count
+		}
+		taskGroup.Constraints = overlayConstraints(taskGroup.Constraints, groupOverlay.Constraints)
+		taskGroup.Meta = overlayMeta(taskGroup.Meta, groupOverlay.Meta)
+
+		for taskName, taskOverlay := range groupOverlay.Tasks {
+			task := findTask(taskGroup, taskName)
+			if task == nil {
+				return fmt.Errorf("task %q of group %q from overlay not found in job %s", taskName, groupName, jobID(parsedFile))
+			}
+
+			if taskOverlay.Resources != nil {
+				if task.Resources == nil {
+					task.Resources = &nomadapi.Resources{}
+				}
+				if taskOverlay.Resources.CPU != nil {
+					cpu := *taskOverlay.Resources.CPU
+					task.Resources.CPU = &cpu
+				}
+				if taskOverlay.Resources.MemoryMB != nil {
+					memory := *taskOverlay.Resources.MemoryMB
+					task.Resources.MemoryMB = &memory
+				}
+			}
+			task.Env = overlayMeta(task.Env, taskOverlay.Env)
+			task.Meta = overlayMeta(task.Meta, taskOverlay.Meta)
+		}
+	}
+
+	return nil
+}
+
+// Overrides the value of the constraints with the same attribute, missing constraints are added with the "=" operator.
+func overlayConstraints(constraints []*nomadapi.Constraint, overlay map[string]string) []*nomadapi.Constraint {
+	for attribute, value := range overlay {
+		found := false
+		for _, constraint := range constraints {
+			if constraint.LTarget == attribute {
+				constraint.RTarget = value
+				found = true
+			}
+		}
+
+		if !found {
+			constraints = append(constraints, nomadapi.NewConstraint(attribute, "=", value))
+		}
+	}
+
+	return constraints
+}
+
+func overlayMeta(meta map[string]string, overlay map[string]string) map[string]string {
+	if len(overlay) == 0 {
+		return meta
+	}
+	if meta == nil {
+		meta = make(map[string]string)
+	}
+
+	for k, v := range overlay {
+		meta[k] = v
+	}
+
+	return meta
+}
+
+func findTaskGroup(parsedFile *nomadapi.Job, groupName string) *nomadapi.TaskGroup {
+	for _, taskGroup := range parsedFile.TaskGroups {
+		if taskGroup.Name != nil && *taskGroup.Name == groupName {
+			return taskGroup
+		}
+	}
+
+	return nil
+}
+
+func findTask(taskGroup *nomadapi.TaskGroup, taskName string) *nomadapi.Task {
+	for _, task := range taskGroup.Tasks {
+		if task.Name == taskName {
+			return task
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,213 @@
+// Lookup placeholders in nomad job files.
+// Placeholders are resolved when the job file is loaded, the job file itself is never modified.
+//
+//	${cs:discover "provider=aws tag_key=join_tag tag_value=consul-server"}  first address found by go-discover
+//	${cs:consul "kv/path"}                                                 value of a consul KV key
+//	${cs:service "name"}                                                   host:port of a healthy instance of a consul service
+//
+// Before the job file is parsed every placeholder is replaced by a token, and the values are only looked up and
+// set on the string fields of the parsed job that hold a token. The values never go through the HCL/JSON text,
+// so quotes, newlines or ${ in a value can't change the job, and placeholders in comments are not looked up.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+
+	discover "github.com/hashicorp/go-discover"
+
+	nomadapi "github.com/hashicorp/nomad/api"
+
+	"./utils"
+)
+
+const (
+	ERR_JOB_PLACEHOLDER = 17
+)
+
+// The quotes may be escaped when the placeholder is inside a JSON job file.
+var jobPlaceholderRegexp = regexp.MustCompile(`\$\{cs:([a-z]+)\s+\\?"([^"\\]*)\\?"\s*\}`)
+
+var jobPlaceholderTokenRegexp = regexp.MustCompile(`__cs_placeholder_[0-9]+__`)
+
+type JobPlaceholder struct {
+	Text   string
+	Lookup string
+	Arg    string
+}
+
+// Replaces the placeholders of the job file by tokens, returns the placeholder of every token.
+func tokenizeJobPlaceholders(content []byte) ([]byte, map[string]*JobPlaceholder) {
+	placeholders := make(map[string]*JobPlaceholder)
+	tokens := make(map[string]string)
+
+	content = jobPlaceholderRegexp.ReplaceAllFunc(content, func(placeholder []byte) []byte {
+		if token, ok := tokens[string(placeholder)]; ok {
+			return []byte(token)
+		}
+
+		match := jobPlaceholderRegexp.FindSubmatch(placeholder)
+		token := fmt.Sprintf("__cs_placeholder_%d__", len(tokens))
+		tokens[string(placeholder)] = token
+		placeholders[token] = &JobPlaceholder{Text: string(placeholder), Lookup: string(match[1]), Arg: string(match[2])}
+
+		return []byte(token)
+	})
+
+	return content, placeholders
+}
+
+// Looks up the placeholders whose tokens are in the string fields of the parsed job and sets their values.
+func resolveJobPlaceholders(parsedFile *nomadapi.Job, placeholders map[string]*JobPlaceholder) error {
+	if len(placeholders) == 0 {
+		return nil
+	}
+
+	resolved := make(map[string]string)
+	return replaceJobStrings(reflect.ValueOf(parsedFile), func(value string) (string, error) {
+		var resolveErr error
+		value = jobPlaceholderTokenRegexp.ReplaceAllStringFunc(value, func(token string) string {
+			if resolveErr != nil {
+				return token
+			}
+			if resolvedValue, ok := resolved[token]; ok {
+				return resolvedValue
+			}
+
+			placeholder, ok := placeholders[token]
+			if !ok {
+				return token
+			}
+			resolvedValue, err := resolveJobPlaceholder(placeholder.Lookup, placeholder.Arg)
+			if err != nil {
+				resolveErr = fmt.Errorf("%s: %s", placeholder.Text, err)
+				return token
+			}
+
+			log.Printf("Resolved %s to %s", placeholder.Text, resolvedValue)
+			resolved[token] = resolvedValue
+
+			return resolvedValue
+		})
+
+		return value, resolveErr
+	})
+}
+
+// Calls replace on every string of the value: fields, slice elements and map values, also inside interfaces
+// (the driver config of a task).
+func replaceJobStrings(v reflect.Value, replace func(string) (string, error)) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		return replaceJobStrings(v.Elem(), replace)
+	case reflect.Interface:
+		if v.IsNil() || !v.CanSet() {
+			return nil
+		}
+		elem := reflect.New(v.Elem().Type()).Elem()
+		elem.Set(v.Elem())
+		if err := replaceJobStrings(elem, replace); err != nil {
+			return err
+		}
+		v.Set(elem)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Field(i).CanSet() {
+				if err := replaceJobStrings(v.Field(i), replace); err != nil {
+					return err
+				}
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := replaceJobStrings(v.Index(i), replace); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			elem.Set(v.MapIndex(key))
+			if err := replaceJobStrings(elem, replace); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, elem)
+		}
+	case reflect.String:
+		if !v.CanSet() || !strings.Contains(v.String(), "__cs_placeholder_") {
+			return nil
+		}
+		value, err := replace(v.String())
+		if err != nil {
+			return err
+		}
+		v.SetString(value)
+	}
+
+	return nil
+}
+
+func resolveJobPlaceholder(lookup string, arg string) (string, error) {
+	switch lookup {
+	case "discover":
+		return discoverAddress(arg)
+	case "consul":
+		return consulKVValue(arg)
+	case "service":
+		return serviceAddress(arg)
+	default:
+		return "", fmt.Errorf("unsupported lookup %q, expected discover, consul or service", lookup)
+	}
+}
+
+func discoverAddress(cfg string) (string, error) {
+	d := discover.Discover{
+		Providers: map[string]discover.Provider{
+			"aws": discover.Providers["aws"],
+		},
+	}
+
+	l := log.New(os.Stderr, "", log.LstdFlags)
+
+	addrs, err := d.Addrs(cfg, l)
+	if err != nil {
+		return "", err
+	}
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("no addresses found")
+	}
+
+	return addrs[0], nil
+}
+
+func consulKVValue(key string) (string, error) {
+	kvpair, _, err := utils.GetConsulClient().KV().Get(key, nil)
+	if err != nil {
+		return "", err
+	}
+	if kvpair == nil {
+		return "", fmt.Errorf("key %s not found in consul", key)
+	}
+
+	return string(kvpair.Value), nil
+}
+
+func serviceAddress(serviceName string) (string, error) {
+	serviceAddresses, _, err := utils.GetServiceAddresses(serviceName, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	if len(serviceAddresses) == 0 {
+		return "", fmt.Errorf("no healthy instances of service %s in consul", serviceName)
+	}
+
+	return fmt.Sprintf("%s:%d", serviceAddresses[0].Host, serviceAddresses[0].Port), nil
+}
@@ -0,0 +1,245 @@
+// Versioned registry of rendered job specs in consul KV (cs jobs push/pull/list/show).
+// Every push stores the rendered job, its hash and the images of its docker tasks under jobs/<job id>/<version>,
+// so a known-good job can be redeployed exactly with cs run consul://jobs/<job id>@<version>, whatever
+// happened to the job file since.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/viper"
+
+	consulapi "github.com/hashicorp/consul/api"
+	nomadapi "github.com/hashicorp/nomad/api"
+)
+
+const (
+	JOB_REGISTRY_CONSUL_PATH = "jobs/"
+	ERR_JOB_REGISTRY         = 40
+)
+
+type JobSpecVersion struct {
+	JobID       string            `json:"job_id"`
+	Version     int               `json:"version"`
+	JobHash     string            `json:"job_hash"`
+	ArtifactIDs map[string]string `json:"artifact_ids"`
+	Source      string            `json:"source"`
+	User        string            `json:"user"`
+	Hostname    string            `json:"hostname"`
+	Profile     string            `json:"profile"`
+	Pushed      time.Time         `json:"pushed"`
+	Spec        string            `json:"spec"`
+}
+
+func jobSpecVersionKey(job_id string, version int) string {
+	return fmt.Sprintf("%s%s/%d", JOB_REGISTRY_CONSUL_PATH, job_id, version)
+}
+
+// Splits <job id>@<version>, the version is 0 (the latest) when it's not given.
+func parseJobVersionRef(ref string) (string, int, error) {
+	i := strings.LastIndex(ref, "@")
+	if i < 0 {
+		return ref, 0, nil
+	}
+
+	version, err := strconv.Atoi(ref[i+1:])
+	if err != nil || version <= 0 {
+		return "", 0, fmt.Errorf("invalid version in %s", ref)
+	}
+
+	return ref[:i], version, nil
+}
+
+// Stores the rendered job as the next version of the job, unless it's the same as the latest version.
+func pushJobSpec(consulClient *consulapi.Client, parsedFile *nomadapi.Job, source string) *JobSpecVersion {
+	job_id := jobID(parsedFile)
+	spec := renderNomadJob(parsedFile)
+
+	versions, err := listJobSpecVersions(consulClient, job_id)
+	if err != nil {
+		fmt.Printf("Unable to list the versions of job %s, Error: %s \n", job_id, err)
+		exitWith(ERR_JOB_REGISTRY)
+	}
+	if len(versions) > 0 && versions[len(versions)-1].JobHash == contentHash(spec) {
+		latest := versions[len(versions)-1]
+		fmt.Printf("Job %s (job hash %s) is already version %d \n", job_id, latest.JobHash, latest.Version)
+		return latest
+	}
+
+	version := 1
+	if len(versions) > 0 {
+		version = versions[len(versions)-1].Version + 1
+	}
+
+	user, hostname := currentIdentity()
+	jobSpec := &JobSpecVersion{
+		JobID:       job_id,
+		Version:     version,
+		JobHash:     contentHash(spec),
+		ArtifactIDs: make(map[string]string),
+		Source:      source,
+		User:        user,
+		Hostname:    hostname,
+		Profile:     viper.GetString("active"),
+		Pushed:      time.Now().UTC().Truncate(time.Second),
+		Spec:        string(spec),
+	}
+	for _, taskImage := range dockerTaskImages(parsedFile) {
+		jobSpec.ArtifactIDs[taskImage.Group+"."+taskImage.Task] = taskImage.Image
+	}
+
+	value, _ := json.Marshal(jobSpec)
+	key := jobSpecVersionKey(job_id, jobSpec.Version)
+	if dryRun {
+		printDryRun("would write version %d of job %s (job hash %s) to consul key %s \n", jobSpec.Version, job_id, jobSpec.JobHash, key)
+		return jobSpec
+	}
+
+	// a version is never overwritten, CAS with index 0 only writes a key that doesn't exist
+	stored, _, err := consulClient.KV().CAS(&consulapi.KVPair{Key: key, Value: value, ModifyIndex: 0}, nil)
+	if err != nil {
+		fmt.Printf("Unable to write version %d of job %s to consul, Error: %s \n", jobSpec.Version, job_id, err)
+		exitWith(ERR_JOB_REGISTRY)
+	}
+	if !stored {
+		fmt.Printf("Version %d of job %s was pushed concurrently, push again \n", jobSpec.Version, job_id)
+		exitWith(ERR_JOB_REGISTRY)
+	}
+
+	return jobSpec
+}
+
+// The versions of the job, oldest first.
+func listJobSpecVersions(consulClient *consulapi.Client, job_id string) ([]*JobSpecVersion, error) {
+	kvpairs, _, err := consulClient.KV().List(JOB_REGISTRY_CONSUL_PATH+job_id+"/", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]*JobSpecVersion, 0, len(kvpairs))
+	for _, kvpair := range kvpairs {
+		var jobSpec JobSpecVersion
+		if err := json.Unmarshal(kvpair.Value, &jobSpec); err != nil {
+			return nil, fmt.Errorf("malformed job spec %s: %s", kvpair.Key, err)
+		}
+		versions = append(versions, &jobSpec)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+
+	return versions, nil
+}
+
+// Reads a version of the job, the latest when version is 0, and checks the spec still matches its hash.
+func readJobSpecVersion(consulClient *consulapi.Client, job_id string, version int) (*JobSpecVersion, error) {
+	if version == 0 {
+		versions, err := listJobSpecVersions(consulClient, job_id)
+		if err != nil {
+			return nil, err
+		}
+		if len(versions) == 0 {
+			return nil, fmt.Errorf("no versions of job %s in the registry", job_id)
+		}
+		version = versions[len(versions)-1].Version
+	}
+
+	kvpair, _, err := consulClient.KV().Get(jobSpecVersionKey(job_id, version), nil)
+	if err != nil {
+		return nil, err
+	}
+	if kvpair == nil {
+		return nil, fmt.Errorf("no version %d of job %s in the registry", version, job_id)
+	}
+
+	var jobSpec JobSpecVersion
+	if err := json.Unmarshal(kvpair.Value, &jobSpec); err != nil {
+		return nil, fmt.Errorf("malformed job spec %s: %s", kvpair.Key, err)
+	}
+	if contentHash([]byte(jobSpec.Spec)) != jobSpec.JobHash {
+		return nil, fmt.Errorf("version %d of job %s doesn't match its job hash %s", version, job_id, jobSpec.JobHash)
+	}
+
+	return &jobSpec, nil
+}
+
+// Reads the version of the job given on the command line, the latest when it's empty.
+func mustReadJobSpecVersion(consulClient *consulapi.Client, job_id string, versionArg string) *JobSpecVersion {
+	version := 0
+	if versionArg != "" {
+		var err error
+		if version, err = strconv.Atoi(versionArg); err != nil || version <= 0 {
+			fmt.Printf("Invalid version: %s \n", versionArg)
+			exitWith(ERR_JOB_REGISTRY)
+		}
+	}
+
+	jobSpec, err := readJobSpecVersion(consulClient, job_id, version)
+	if err != nil {
+		fmt.Printf("Unable to read job %s from the registry, Error: %s \n", job_id, err)
+		exitWith(ERR_JOB_REGISTRY)
+	}
+
+	return jobSpec
+}
+
+func listRegisteredJobs(consulClient *consulapi.Client) {
+	keys, _, err := consulClient.KV().Keys(JOB_REGISTRY_CONSUL_PATH, "/", nil)
+	if err != nil {
+		fmt.Printf("Unable to list the jobs of the registry, Error: %s \n", err)
+		exitWith(ERR_JOB_REGISTRY)
+	}
+
+	for _, key := range keys {
+		fmt.Println(strings.TrimSuffix(strings.TrimPrefix(key, JOB_REGISTRY_CONSUL_PATH), "/"))
+	}
+}
+
+func printJobSpecVersions(consulClient *consulapi.Client, job_id string) {
+	versions, err := listJobSpecVersions(consulClient, job_id)
+	if err != nil {
+		fmt.Printf("Unable to list the versions of job %s, Error: %s \n", job_id, err)
+		exitWith(ERR_JOB_REGISTRY)
+	}
+	if len(versions) == 0 {
+		fmt.Printf("No versions of job %s in the registry \n", job_id)
+		return
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(writer, "version\tpushed\tby\tprofile\tjob hash\timages\n")
+	for _, jobSpec := range versions {
+		fmt.Fprintf(writer, "%d\t%s\t%s@%s\t%s\t%s\t%s\n", jobSpec.Version, jobSpec.Pushed.Local().Format("2006-01-02 15:04:05"),
+			jobSpec.User, jobSpec.Hostname, jobSpec.Profile, shortID(jobSpec.JobHash), strings.Join(jobSpec.images(), ", "))
+	}
+	writer.Flush()
+}
+
+func printJobSpecVersion(jobSpec *JobSpecVersion) {
+	fmt.Printf("job:      %s \n", jobSpec.JobID)
+	fmt.Printf("version:  %d \n", jobSpec.Version)
+	fmt.Printf("job hash: %s \n", jobSpec.JobHash)
+	fmt.Printf("pushed:   %s by %s@%s (profile %s) \n", jobSpec.Pushed.Local().Format("2006-01-02 15:04:05"),
+		jobSpec.User, jobSpec.Hostname, jobSpec.Profile)
+	fmt.Printf("source:   %s \n", jobSpec.Source)
+	fmt.Printf("images: \n")
+	for _, image := range jobSpec.images() {
+		fmt.Printf("  %s \n", image)
+	}
+}
+
+func (v *JobSpecVersion) images() []string {
+	images := make([]string, 0, len(v.ArtifactIDs))
+	for task, image := range v.ArtifactIDs {
+		images = append(images, task+"="+image)
+	}
+	sort.Strings(images)
+
+	return images
+}
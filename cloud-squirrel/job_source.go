@@ -0,0 +1,265 @@
+// Job files that are not local: the job file argument of cs run, validate, drift etc. can also be an S3 object,
+// a file of a git repo at a ref, a Consul KV key or a version of the job registry (see job_registry.go):
+//
+//	s3://bucket/jobs/scoring.nomad
+//	git::https://github.com/org/jobs.git//scoring/scoring.nomad?ref=v1.2.0
+//	consul://config/scoring.nomad
+//	consul://jobs/scoring@4
+//
+// The remote job file is fetched into a temporary directory and read from there. The source, with the git ref
+// resolved to its commit, is pinned in the audit record next to the content hash of the job file.
+// Only a git source brings the env overlays next to the job file along, --env is refused for the other sources.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+
+	"./utils"
+)
+
+const (
+	JOB_SOURCE_S3     = "s3://"
+	JOB_SOURCE_GIT    = "git::"
+	JOB_SOURCE_CONSUL = "consul://"
+)
+
+func isRemoteJobSource(job_file string) bool {
+	for _, prefix := range []string{JOB_SOURCE_S3, JOB_SOURCE_GIT, JOB_SOURCE_CONSUL} {
+		if strings.HasPrefix(job_file, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Whether the env overlays of the job file can be found next to it: for local files and the files of a git repo.
+// An S3 object or a consul key is fetched alone, and the versions of the job registry are already rendered with their overlay.
+func jobSourceHasOverlays(job_file string) bool {
+	return !isRemoteJobSource(job_file) || strings.HasPrefix(job_file, JOB_SOURCE_GIT)
+}
+
+// Returns the local path of the job file, its content and the pinned source of a remote job file.
+// The returned cleanup removes what was fetched.
+func readJobSource(job_file string) (string, []byte, string, func()) {
+	if !isRemoteJobSource(job_file) {
+		path, err := filepath.Abs(job_file)
+		if err != nil {
+			fmt.Printf(" Unable to open nomad job file: %s, Error:  %s \n", job_file, err)
+			exitWith(ERR_OPEN_JOB_FILE)
+		}
+
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			fmt.Printf(" Unable to open nomad job file: %s, Error:  %s \n", job_file, err)
+			exitWith(ERR_OPEN_JOB_FILE)
+		}
+
+		return path, content, "", func() {}
+	}
+
+	dir, err := ioutil.TempDir("", "cs-job-")
+	if err != nil {
+		fmt.Printf(" Unable to fetch nomad job file: %s, Error:  %s \n", job_file, err)
+		exitWith(ERR_OPEN_JOB_FILE)
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	var path, source string
+	switch {
+	case strings.HasPrefix(job_file, JOB_SOURCE_S3):
+		path, source, err = fetchS3JobFile(job_file, dir)
+	case strings.HasPrefix(job_file, JOB_SOURCE_GIT):
+		path, source, err = fetchGitJobFile(job_file, dir)
+	default:
+		path, source, err = fetchConsulJobFile(job_file, dir)
+	}
+	if err != nil {
+		cleanup()
+		fmt.Printf(" Unable to fetch nomad job file: %s, Error:  %s \n", job_file, err)
+		exitWith(ERR_OPEN_JOB_FILE)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		cleanup()
+		fmt.Printf(" Unable to open nomad job file: %s, Error:  %s \n", job_file, err)
+		exitWith(ERR_OPEN_JOB_FILE)
+	}
+	fmt.Fprintf(os.Stderr, "Fetched job file %s (content hash: %s) \n", source, contentHash(content))
+
+	return path, content, source, cleanup
+}
+
+func newS3Downloader() *s3manager.Downloader {
+	awskid := utils.GetDataFromVault(AWS_KEY_ID)
+	awssak := utils.GetDataFromVault(AWS_ACCESS_KEY)
+	aws_region := utils.GetConfigString("region")
+	sess, _ := session.NewSession(&aws.Config{
+		Region:      aws.String(aws_region),
+		Credentials: credentials.NewStaticCredentials(awskid, awssak, ""),
+	},
+	)
+
+	return s3manager.NewDownloader(sess)
+}
+
+func downloadFromS3(file *os.File, bucket string, key string) (int64, error) {
+	return newS3Downloader().Download(file,
+		&s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+}
+
+// s3://bucket/key
+func fetchS3JobFile(job_file string, dir string) (string, string, error) {
+	location, err := url.Parse(job_file)
+	if err != nil {
+		return "", "", err
+	}
+	key := strings.TrimPrefix(location.Path, "/")
+	if location.Host == "" || key == "" {
+		return "", "", fmt.Errorf("expected s3://bucket/key")
+	}
+
+	jobPath := filepath.Join(dir, path.Base(key))
+	file, err := os.Create(jobPath)
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+
+	if _, err := downloadFromS3(file, location.Host, key); err != nil {
+		return "", "", err
+	}
+
+	return jobPath, job_file, nil
+}
+
+// git::repo//path/in/repo?ref=tag, the ref defaults to the default branch of the repo.
+// The source is pinned to the commit the ref resolved to.
+func fetchGitJobFile(job_file string, dir string) (string, string, error) {
+	address := strings.TrimPrefix(job_file, JOB_SOURCE_GIT)
+
+	ref := ""
+	if i := strings.LastIndex(address, "?"); i >= 0 {
+		query, err := url.ParseQuery(address[i+1:])
+		if err != nil {
+			return "", "", err
+		}
+		ref = query.Get("ref")
+		address = address[:i]
+	}
+
+	// the // after the scheme of the repo url belongs to the url
+	start := 0
+	if i := strings.Index(address, "://"); i >= 0 {
+		start = i + len("://")
+	}
+	i := strings.Index(address[start:], "//")
+	if i < 0 {
+		return "", "", fmt.Errorf("expected git::repo//path/in/repo?ref=tag")
+	}
+	repo := address[:start+i]
+	jobPath := path.Clean(address[start+i+len("//"):])
+	if path.IsAbs(jobPath) || jobPath == ".." || strings.HasPrefix(jobPath, "../") {
+		return "", "", fmt.Errorf("the path in the repo %s must be relative and stay inside the repo", jobPath)
+	}
+
+	if err := runGit("", "clone", "--quiet", repo, dir); err != nil {
+		return "", "", err
+	}
+	if ref != "" {
+		if err := runGit(dir, "checkout", "--quiet", ref); err != nil {
+			return "", "", err
+		}
+	}
+
+	out, err := exec.Command("git", "-C", dir, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return "", "", fmt.Errorf("git rev-parse HEAD: %s", err)
+	}
+	commit := strings.TrimSpace(string(out))
+
+	// also after following the symlinks of the repo
+	localPath := filepath.Join(dir, filepath.FromSlash(jobPath))
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", "", err
+	}
+	realPath, err := filepath.EvalSymlinks(localPath)
+	if err != nil {
+		return "", "", err
+	}
+	if rel, err := filepath.Rel(realDir, realPath); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", "", fmt.Errorf("the path in the repo %s is outside the repo", jobPath)
+	}
+
+	return localPath, fmt.Sprintf("%s%s//%s?ref=%s", JOB_SOURCE_GIT, repo, jobPath, commit), nil
+}
+
+func runGit(dir string, args ...string) error {
+	if dir != "" {
+		args = append([]string{"-C", dir}, args...)
+	}
+
+	out, err := exec.Command("git", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("git %s: %s %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// consul://key/in/kv, or consul://jobs/<job id>@<version> for a version of the job registry (the latest without @<version>).
+func fetchConsulJobFile(job_file string, dir string) (string, string, error) {
+	key := strings.TrimPrefix(job_file, JOB_SOURCE_CONSUL)
+
+	if strings.HasPrefix(key, JOB_REGISTRY_CONSUL_PATH) {
+		job_id, version, err := parseJobVersionRef(strings.TrimPrefix(key, JOB_REGISTRY_CONSUL_PATH))
+		if err != nil {
+			return "", "", err
+		}
+		jobSpec, err := readJobSpecVersion(utils.GetConsulClient(), job_id, version)
+		if err != nil {
+			return "", "", err
+		}
+
+		jobPath := filepath.Join(dir, job_id+".nomad.json")
+		if err := ioutil.WriteFile(jobPath, []byte(jobSpec.Spec), 0644); err != nil {
+			return "", "", err
+		}
+
+		return jobPath, fmt.Sprintf("%s%s%s@%d", JOB_SOURCE_CONSUL, JOB_REGISTRY_CONSUL_PATH, job_id, jobSpec.Version), nil
+	}
+
+	kvpair, _, err := utils.GetConsulClient().KV().Get(key, nil)
+	if err != nil {
+		return "", "", err
+	}
+	if kvpair == nil {
+		return "", "", fmt.Errorf("key %s not found in consul", key)
+	}
+
+	jobPath := filepath.Join(dir, path.Base(key))
+	if err := ioutil.WriteFile(jobPath, kvpair.Value, 0644); err != nil {
+		return "", "", err
+	}
+
+	return jobPath, job_file, nil
+}
@@ -0,0 +1,205 @@
+// Registers jobs through the nomad API and follows the evaluation and the deployment
+// until the job is placed and healthy.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	nomadapi "github.com/hashicorp/nomad/api"
+)
+
+const (
+	ERR_NOMAD_API          = 18
+	ERR_PLACEMENT_FAILED   = 19
+	ERR_DEPLOYMENT_FAILED  = 20
+	ERR_DEPLOYMENT_TIMEOUT = 21
+
+	NOMAD_POLL_INTERVAL = 2 * time.Second
+)
+
+type DeployOptions struct {
+	Detach       bool
+	Timeout      time.Duration
+	AutoRollback bool
+}
+
+// Registers the job and, unless detach is set, waits for its evaluation and deployment.
+// Returns the evaluation id and the exit code for the command: EXIT_SUCCESS or one of the ERR_* codes above.
+func submitNomadJob(nomadClient *nomadapi.Client, parsedFile *nomadapi.Job, deployOptions *DeployOptions) (string, int) {
+	if dryRun {
+		printDryRun("would submit job %s: \n%s \n", jobID(parsedFile), renderNomadJob(parsedFile))
+		printPlanDiff(nomadClient, parsedFile)
+		return "", EXIT_SUCCESS
+	}
+
+	resp, _, err := nomadClient.Jobs().Register(parsedFile, nil)
+	if err != nil {
+		fmt.Printf("Unable to register job %s with nomad, Error: %s \n", jobID(parsedFile), err)
+		return "", ERR_NOMAD_API
+	}
+
+	if resp.Warnings != "" {
+		fmt.Printf("Job warnings: \n%s \n", resp.Warnings)
+	}
+
+	if resp.EvalID == "" {
+		// periodic and parameterized jobs are not evaluated when registered
+		fmt.Printf("Job %s registered. \n", jobID(parsedFile))
+		return "", EXIT_SUCCESS
+	}
+
+	fmt.Printf("Job %s registered, evaluation ID: %s \n", jobID(parsedFile), resp.EvalID)
+	if deployOptions.Detach {
+		return resp.EvalID, EXIT_SUCCESS
+	}
+
+	return resp.EvalID, monitorNomadEvaluation(nomadClient, resp.EvalID, time.Now().Add(deployOptions.Timeout), deployOptions.AutoRollback)
+}
+
+// With autoPromote set the canaries of the deployment are promoted as soon as they are healthy.
+func monitorNomadEvaluation(nomadClient *nomadapi.Client, evalID string, deadline time.Time, autoPromote bool) int {
+	lastStatus := ""
+
+	for {
+		eval, _, err := nomadClient.Evaluations().Info(evalID, nil)
+		if err != nil {
+			fmt.Printf("Unable to get evaluation %s from nomad, Error: %s \n", evalID, err)
+			return ERR_NOMAD_API
+		}
+
+		if eval.Status != lastStatus {
+			fmt.Printf("Evaluation %s status: %s \n", shortID(evalID), eval.Status)
+			lastStatus = eval.Status
+		}
+
+		switch eval.Status {
+		case "complete":
+			if len(eval.FailedTGAllocs) > 0 {
+				printPlacementFailures(eval.FailedTGAllocs)
+				return ERR_PLACEMENT_FAILED
+			}
+			if eval.DeploymentID == "" {
+				fmt.Printf("Evaluation %s complete, no deployment to monitor. \n", shortID(evalID))
+				return EXIT_SUCCESS
+			}
+			return monitorNomadDeployment(nomadClient, eval.DeploymentID, deadline, autoPromote)
+		case "failed", "canceled":
+			fmt.Printf("Evaluation %s %s: %s \n", shortID(evalID), eval.Status, eval.StatusDescription)
+			return ERR_PLACEMENT_FAILED
+		}
+
+		if time.Now().After(deadline) {
+			fmt.Printf("Timed out waiting for evaluation %s \n", evalID)
+			return ERR_DEPLOYMENT_TIMEOUT
+		}
+
+		time.Sleep(NOMAD_POLL_INTERVAL)
+	}
+}
+
+func monitorNomadDeployment(nomadClient *nomadapi.Client, deploymentID string, deadline time.Time, autoPromote bool) int {
+	lastProgress := ""
+	promoted := false
+
+	for {
+		deployment, _, err := nomadClient.Deployments().Info(deploymentID, nil)
+		if err != nil {
+			fmt.Printf("Unable to get deployment %s from nomad, Error: %s \n", deploymentID, err)
+			return ERR_NOMAD_API
+		}
+
+		progress := deploymentProgress(deployment)
+		if progress != lastProgress {
+			fmt.Printf("Deployment %s %s \n", shortID(deploymentID), progress)
+			lastProgress = progress
+		}
+
+		if autoPromote && !promoted && canariesHealthy(deployment) {
+			fmt.Printf("Canaries of deployment %s are healthy, promoting. \n", shortID(deploymentID))
+			if _, _, err := nomadClient.Deployments().PromoteAll(deploymentID, nil); err != nil {
+				fmt.Printf("Unable to promote deployment %s, Error: %s \n", deploymentID, err)
+				return ERR_DEPLOYMENT_FAILED
+			}
+			promoted = true
+		}
+
+		switch deployment.Status {
+		case "successful":
+			fmt.Printf("Deployment %s successful. \n", shortID(deploymentID))
+			return EXIT_SUCCESS
+		case "failed", "cancelled":
+			fmt.Printf("Deployment %s %s: %s \n", shortID(deploymentID), deployment.Status, deployment.StatusDescription)
+			return ERR_DEPLOYMENT_FAILED
+		}
+
+		if time.Now().After(deadline) {
+			fmt.Printf("Timed out waiting for deployment %s, status: %s \n", deploymentID, deployment.StatusDescription)
+			return ERR_DEPLOYMENT_TIMEOUT
+		}
+
+		time.Sleep(NOMAD_POLL_INTERVAL)
+	}
+}
+
+// True when the deployment waits for promotion and all the canaries it placed are healthy.
+func canariesHealthy(deployment *nomadapi.Deployment) bool {
+	if deployment.Status != "running" {
+		return false
+	}
+
+	waitingForPromotion := false
+	for _, state := range deployment.TaskGroups {
+		if state.DesiredCanaries == 0 || state.Promoted {
+			continue
+		}
+		if len(state.PlacedCanaries) < state.DesiredCanaries || state.HealthyAllocs < state.DesiredCanaries {
+			return false
+		}
+		waitingForPromotion = true
+	}
+
+	return waitingForPromotion
+}
+
+// e.g. "running: web healthy 1/3 (placed 2, unhealthy 0)"
+func deploymentProgress(deployment *nomadapi.Deployment) string {
+	groups := make([]string, 0, len(deployment.TaskGroups))
+	for group := range deployment.TaskGroups {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	states := make([]string, 0, len(groups))
+	for _, group := range groups {
+		state := deployment.TaskGroups[group]
+		states = append(states, fmt.Sprintf("%s healthy %d/%d (placed %d, unhealthy %d)",
+			group, state.HealthyAllocs, state.DesiredTotal, state.PlacedAllocs, state.UnhealthyAllocs))
+	}
+
+	return fmt.Sprintf("%s: %s", deployment.Status, strings.Join(states, ", "))
+}
+
+func printPlacementFailures(failedTGAllocs map[string]*nomadapi.AllocationMetric) {
+	for group, metric := range failedTGAllocs {
+		fmt.Printf("Failed to place allocations of group %q: %d nodes evaluated, %d filtered, %d exhausted \n",
+			group, metric.NodesEvaluated, metric.NodesFiltered, metric.NodesExhausted)
+		for constraint, count := range metric.ConstraintFiltered {
+			fmt.Printf("  constraint %q filtered %d nodes \n", constraint, count)
+		}
+		for dimension, count := range metric.DimensionExhausted {
+			fmt.Printf("  resources exhausted on %d nodes: %s \n", count, dimension)
+		}
+	}
+}
+
+func shortID(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+
+	return id
+}
@@ -0,0 +1,118 @@
+// Dispatches parameterized jobs and forces runs of periodic jobs.
+// Every child job consumes resources, so the quota of the parent's env--group is checked first.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	nomadapi "github.com/hashicorp/nomad/api"
+)
+
+const (
+	ERR_DISPATCH = 25
+)
+
+func dispatchNomadJob(nomadClient *nomadapi.Client, consulClient *consulapi.Client, job_id string, payloadFile string, metaArgs []string, deployOptions *DeployOptions) {
+	parentJob, _, err := nomadClient.Jobs().Info(job_id, nil)
+	if err != nil {
+		fmt.Printf("Unable to get job %s from nomad, Error: %s \n", job_id, err)
+		exitWith(ERR_NOMAD_API)
+	}
+
+	if !parentJob.IsParameterized() && !parentJob.IsPeriodic() {
+		fmt.Printf("Job %s is neither parameterized nor periodic, use cs run instead \n", job_id)
+		exitWith(ERR_DISPATCH)
+	}
+
+	auditJob(parentJob)
+
+	// a child job is a copy of its parent, so it needs the resources of the parent
+	for _, quota_key := range []string{"cpu", "memory"} {
+		checkQuotaDelta(quota_key, parentJob.Constraints, jobResourceAmount(quota_key, parentJob), consulClient)
+	}
+
+	if dryRun {
+		printDryRun("would dispatch job %s with meta %v \n", job_id, metaArgs)
+		return
+	}
+
+	var evalID string
+	if parentJob.IsParameterized() {
+		meta, err := parseDispatchMeta(metaArgs)
+		if err != nil {
+			fmt.Printf("Invalid --meta, Error: %s \n", err)
+			exitWith(ERR_DISPATCH)
+		}
+
+		resp, _, err := nomadClient.Jobs().Dispatch(job_id, meta, readDispatchPayload(payloadFile), "", nil)
+		if err != nil {
+			fmt.Printf("Unable to dispatch job %s, Error: %s \n", job_id, err)
+			exitWith(ERR_NOMAD_API)
+		}
+
+		fmt.Printf("Dispatched job %s, evaluation ID: %s \n", resp.DispatchedJobID, resp.EvalID)
+		evalID = resp.EvalID
+	} else {
+		if payloadFile != "" || len(metaArgs) > 0 {
+			fmt.Printf("Job %s is periodic, a payload and --meta are only supported for parameterized jobs \n", job_id)
+			exitWith(ERR_DISPATCH)
+		}
+
+		evalID, _, err = nomadClient.Jobs().PeriodicForce(job_id, nil)
+		if err != nil {
+			fmt.Printf("Unable to force a run of periodic job %s, Error: %s \n", job_id, err)
+			exitWith(ERR_NOMAD_API)
+		}
+
+		fmt.Printf("Forced a run of periodic job %s, evaluation ID: %s \n", job_id, evalID)
+	}
+
+	if deployOptions.Detach || evalID == "" {
+		return
+	}
+
+	if exitCode := monitorNomadEvaluation(nomadClient, evalID, time.Now().Add(deployOptions.Timeout), false); exitCode != EXIT_SUCCESS {
+		exitWith(exitCode)
+	}
+}
+
+// Reads the payload from a file, "-" reads it from stdin.
+func readDispatchPayload(payloadFile string) []byte {
+	if payloadFile == "" {
+		return nil
+	}
+
+	var payload []byte
+	var err error
+	if payloadFile == "-" {
+		payload, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		payload, err = ioutil.ReadFile(payloadFile)
+	}
+	if err != nil {
+		fmt.Printf("Unable to read payload %s, Error: %s \n", payloadFile, err)
+		exitWith(ERR_DISPATCH)
+	}
+
+	return payload
+}
+
+func parseDispatchMeta(metaArgs []string) (map[string]string, error) {
+	meta := make(map[string]string)
+
+	for _, metaArg := range metaArgs {
+		parts := strings.SplitN(metaArg, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("expected key=value, got %q", metaArg)
+		}
+		meta[parts[0]] = parts[1]
+	}
+
+	return meta, nil
+}
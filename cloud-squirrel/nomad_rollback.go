@@ -0,0 +1,159 @@
+// Lists the versions of nomad jobs and reverts jobs to a previous version.
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	nomadapi "github.com/hashicorp/nomad/api"
+)
+
+const (
+	ERR_ROLLBACK_FAILED = 22
+	ERR_JOB_VERSION     = 23
+
+	// installed next to cs, recalculates quotas/usage from the jobs running in nomad
+	QUOTA_USAGE_BINARY = "update_quotas_usage"
+)
+
+// Returns the latest stable version of the job, or nil if the job is new or has never been stable.
+func previousStableJob(nomadClient *nomadapi.Client, jobID string) *nomadapi.Job {
+	versions, _, _, err := nomadClient.Jobs().Versions(jobID, false, nil)
+	if err != nil {
+		return nil
+	}
+
+	// versions are ordered from the newest to the oldest
+	for _, version := range versions {
+		if version.Stable != nil && *version.Stable {
+			return version
+		}
+	}
+
+	return nil
+}
+
+func rollbackNomadJob(nomadClient *nomadapi.Client, stableJob *nomadapi.Job, timeout time.Duration) int {
+	if stableJob == nil {
+		fmt.Printf("No stable version to roll back to. \n")
+		return ERR_ROLLBACK_FAILED
+	}
+
+	if dryRun {
+		printDryRun("would roll back job %s to version %d \n", jobID(stableJob), *stableJob.Version)
+		return EXIT_SUCCESS
+	}
+
+	fmt.Printf("Rolling back job %s to version %d \n", jobID(stableJob), *stableJob.Version)
+
+	resp, _, err := nomadClient.Jobs().Revert(jobID(stableJob), *stableJob.Version, nil, nil, "", "")
+	if err != nil {
+		fmt.Printf("Unable to revert job %s to version %d, Error: %s \n", jobID(stableJob), *stableJob.Version, err)
+		return ERR_ROLLBACK_FAILED
+	}
+
+	if monitorNomadEvaluation(nomadClient, resp.EvalID, time.Now().Add(timeout), false) != EXIT_SUCCESS {
+		fmt.Printf("Rollback of job %s to version %d did not become healthy. \n", jobID(stableJob), *stableJob.Version)
+		return ERR_ROLLBACK_FAILED
+	}
+
+	fmt.Printf("Job %s rolled back to version %d \n", jobID(stableJob), *stableJob.Version)
+
+	return EXIT_SUCCESS
+}
+
+// Recalculates the quota usage in consul right away instead of waiting for the consul watch to pick up the change.
+func restoreQuotaUsage() {
+	if dryRun {
+		printDryRun("would recalculate the quota usage with %s \n", QUOTA_USAGE_BINARY)
+		return
+	}
+
+	out, err := exec.Command(QUOTA_USAGE_BINARY).CombinedOutput()
+	if err != nil {
+		fmt.Printf("%s \n", out)
+		fmt.Printf("Unable to update quota usage with %s, Error: %s \n", QUOTA_USAGE_BINARY, err)
+	}
+}
+
+// Prints the versions of the job, newest first, with their images and what changed compared to the previous version.
+func printJobVersions(versions []*nomadapi.Job, diffs []*nomadapi.JobDiff) {
+	for i, version := range versions {
+		stable := ""
+		if version.Stable != nil && *version.Stable {
+			stable = ", stable"
+		}
+		submitted := ""
+		if version.SubmitTime != nil {
+			submitted = time.Unix(0, *version.SubmitTime).Format(time.RFC3339)
+		}
+
+		fmt.Printf("Version %d (submitted %s%s) \n", *version.Version, submitted, stable)
+		for _, taskImage := range dockerTaskImages(version) {
+			fmt.Printf("  %s.%s image: %s \n", taskImage.Group, taskImage.Task, taskImage.Image)
+		}
+
+		// diffs[i] is the diff between versions[i] and versions[i+1]
+		if i < len(diffs) && diffs[i] != nil {
+			printJobDiff(diffs[i])
+		}
+	}
+}
+
+func printJobDiff(diff *nomadapi.JobDiff) {
+	printFieldDiffs("    ", diff.Fields, diff.Objects)
+	for _, groupDiff := range diff.TaskGroups {
+		if groupDiff.Type == "None" {
+			continue
+		}
+		fmt.Printf("    %s group %q \n", diffMarker(groupDiff.Type), groupDiff.Name)
+		printFieldDiffs("      ", groupDiff.Fields, groupDiff.Objects)
+		for _, taskDiff := range groupDiff.Tasks {
+			if taskDiff.Type == "None" {
+				continue
+			}
+			fmt.Printf("      %s task %q \n", diffMarker(taskDiff.Type), taskDiff.Name)
+			printFieldDiffs("        ", taskDiff.Fields, taskDiff.Objects)
+		}
+	}
+}
+
+func printFieldDiffs(indent string, fields []*nomadapi.FieldDiff, objects []*nomadapi.ObjectDiff) {
+	for _, field := range fields {
+		if field.Type == "None" {
+			continue
+		}
+		fmt.Printf("%s%s %s: %q => %q \n", indent, diffMarker(field.Type), field.Name, field.Old, field.New)
+	}
+	for _, object := range objects {
+		if object.Type == "None" {
+			continue
+		}
+		fmt.Printf("%s%s %s \n", indent, diffMarker(object.Type), object.Name)
+		printFieldDiffs(indent+"  ", object.Fields, object.Objects)
+	}
+}
+
+func diffMarker(diffType string) string {
+	switch strings.ToLower(diffType) {
+	case "added":
+		return "+"
+	case "deleted":
+		return "-"
+	default:
+		return "~"
+	}
+}
+
+func findJobVersion(versions []*nomadapi.Job, version uint64) *nomadapi.Job {
+	for _, jobVersion := range versions {
+		if jobVersion.Version != nil && *jobVersion.Version == version {
+			return jobVersion
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,144 @@
+// Detects static ports that collide with the static ports of the running jobs before a job is submitted.
+// Two groups can land on the same nodes unless their ${node.class}, ${meta.env} or ${meta.group} constraints
+// pin them to different values with = constraints, a group without such a constraint can land anywhere.
+// A set_contains or set_contains_any constraint doesn't keep groups apart: a node whose ${meta.group} is "a,b"
+// satisfies both set_contains "a" and set_contains "b".
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	nomadapi "github.com/hashicorp/nomad/api"
+
+	"./utils"
+)
+
+const (
+	ERR_PORT_CONFLICT = 37
+)
+
+var placementConstraints = []string{"${node.class}", utils.NOMAD_ENV_CONSTRAINT, utils.NOMAD_GROUP_CONSTRAINT}
+
+type StaticPort struct {
+	JobID     string
+	Group     string
+	Label     string
+	Port      int
+	placement map[string]string
+}
+
+func (p *StaticPort) String() string {
+	return fmt.Sprintf("%s.%s port %s (%d)", p.JobID, p.Group, p.Label, p.Port)
+}
+
+// Refuses the job if one of its static ports is also reserved by a running job on the nodes the job can land on.
+func checkStaticPorts(parsedFile *nomadapi.Job) {
+	ports := jobStaticPorts(parsedFile)
+	if len(ports) == 0 {
+		return
+	}
+
+	nomadClient := utils.GetNomadClient()
+	stubs, _, err := nomadClient.Jobs().List(nil)
+	if err != nil {
+		fmt.Printf("Unable to list the nomad jobs to check static ports, Error: %s \n", err)
+		exitWith(ERR_NOMAD_API)
+	}
+
+	// the groups of the job can collide with each other as well
+	runningPorts := ports
+	for _, stub := range stubs {
+		// the dispatched and periodic children of the job (<job id>/dispatch-..., <job id>/periodic-...) are replaced with it
+		if stub.ID == jobID(parsedFile) || stub.ParentID == jobID(parsedFile) || stub.Status == "dead" {
+			continue
+		}
+
+		runningJob, _, err := nomadClient.Jobs().Info(stub.ID, nil)
+		if err != nil {
+			fmt.Printf("Unable to get job %s from nomad, Error: %s \n", stub.ID, err)
+			continue
+		}
+		// their child jobs are the ones that hold the ports
+		if runningJob.IsParameterized() || runningJob.IsPeriodic() {
+			continue
+		}
+		runningPorts = append(runningPorts, jobStaticPorts(runningJob)...)
+	}
+
+	conflicts := make([]string, 0)
+	for i, port := range ports {
+		for j, other := range runningPorts {
+			if j <= i || port.Port != other.Port || !placementsOverlap(port.placement, other.placement) {
+				continue
+			}
+			conflicts = append(conflicts, fmt.Sprintf("%s collides with %s", port, other))
+		}
+	}
+
+	if len(conflicts) > 0 {
+		fmt.Printf("Static ports of job %s are already reserved, will not start job: \n  %s \n", jobID(parsedFile), strings.Join(conflicts, "\n  "))
+		exitWith(ERR_PORT_CONFLICT)
+	}
+}
+
+func jobStaticPorts(job *nomadapi.Job) []*StaticPort {
+	ports := make([]*StaticPort, 0)
+
+	for _, taskGroup := range job.TaskGroups {
+		placement := groupPlacement(job, taskGroup)
+
+		networks := append([]*nomadapi.NetworkResource{}, taskGroup.Networks...)
+		for _, task := range taskGroup.Tasks {
+			if task.Resources != nil {
+				networks = append(networks, task.Resources.Networks...)
+			}
+		}
+
+		for _, network := range networks {
+			for _, reservedPort := range network.ReservedPorts {
+				if reservedPort.Value <= 0 || reservedPort.IgnoreCollision {
+					continue
+				}
+				ports = append(ports, &StaticPort{
+					JobID:     jobID(job),
+					Group:     *taskGroup.Name,
+					Label:     reservedPort.Label,
+					Port:      reservedPort.Value,
+					placement: placement,
+				})
+			}
+		}
+	}
+
+	return ports
+}
+
+// The values the placement constraints pin the group to, the constraints of the group override the job's.
+// Only = pins count, a node can satisfy set_contains constraints of different values at once.
+func groupPlacement(job *nomadapi.Job, taskGroup *nomadapi.TaskGroup) map[string]string {
+	placement := make(map[string]string)
+
+	for _, constraints := range [][]*nomadapi.Constraint{job.Constraints, taskGroup.Constraints} {
+		for _, constraint := range constraints {
+			if containsString(placementConstraints, constraint.LTarget) && (constraint.Operand == "" || constraint.Operand == "=" || constraint.Operand == "==") {
+				placement[constraint.LTarget] = constraint.RTarget
+			}
+		}
+	}
+
+	return placement
+}
+
+func placementsOverlap(placement map[string]string, other map[string]string) bool {
+	for _, lTarget := range placementConstraints {
+		value, ok := placement[lTarget]
+		otherValue, otherOk := other[lTarget]
+		if ok && otherOk && value != otherValue {
+			return false
+		}
+	}
+
+	return true
+}
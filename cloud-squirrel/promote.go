@@ -0,0 +1,108 @@
+// Promotes the docker images of a job running in one environment (config profile) to another.
+// The images are read from the source cluster, the target job is rewritten with them and deployed
+// with the checks of the target profile.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/spf13/viper"
+
+	nomadapi "github.com/hashicorp/nomad/api"
+
+	"./utils"
+)
+
+const (
+	ERR_PROMOTE = 30
+)
+
+// Returns the images of the running job, keyed by group.task.
+func runningJobImages(nomadClient *nomadapi.Client, job_id string) map[string]string {
+	runningJob, _, err := nomadClient.Jobs().Info(job_id, nil)
+	if err != nil {
+		fmt.Printf("Unable to get job %s from nomad, Error: %s \n", job_id, err)
+		exitWith(ERR_NOMAD_API)
+	}
+
+	images := make(map[string]string)
+	for _, taskImage := range dockerTaskImages(runningJob) {
+		images[taskImage.Group+"."+taskImage.Task] = taskImage.Image
+	}
+
+	return images
+}
+
+// Sets the images of the source job on the tasks of the same group and name in the target job.
+// Returns the image changes, every docker task of the target job must have an image in the source job.
+func promoteJobImages(parsedFile *nomadapi.Job, images map[string]string) ([]string, error) {
+	changes := make([]string, 0)
+
+	for _, taskImage := range dockerTaskImages(parsedFile) {
+		key := taskImage.Group + "." + taskImage.Task
+		image, ok := images[key]
+		if !ok {
+			return nil, fmt.Errorf("task %s is not running in the source environment", key)
+		}
+		if image == taskImage.Image {
+			continue
+		}
+
+		task := findTask(findTaskGroup(parsedFile, taskImage.Group), taskImage.Task)
+		task.Config["image"] = image
+		changes = append(changes, fmt.Sprintf("%s: %s => %s", key, taskImage.Image, image))
+	}
+
+	sort.Strings(changes)
+
+	return changes, nil
+}
+
+// Switches the active config profile, the clients and checks created afterwards use the target environment.
+func activateProfile(profile string) {
+	if !viper.IsSet(profile) {
+		fmt.Printf("Unknown config profile: %s \n", profile)
+		exitWith(ERR_PROMOTE)
+	}
+
+	viper.Set("active", profile)
+}
+
+// Prints what would change in the target cluster if the job was submitted.
+func printPlanDiff(nomadClient *nomadapi.Client, parsedFile *nomadapi.Job) {
+	plan, _, err := nomadClient.Jobs().Plan(parsedFile, true, nil)
+	if err != nil {
+		fmt.Printf("Unable to plan job %s, Error: %s \n", jobID(parsedFile), err)
+		return
+	}
+
+	if plan.Diff == nil || plan.Diff.Type == "None" {
+		fmt.Printf("Job %s in profile %s has no changes \n", jobID(parsedFile), viper.GetString("active"))
+		return
+	}
+
+	fmt.Printf("Changes to job %s in profile %s: \n", jobID(parsedFile), viper.GetString("active"))
+	printJobDiff(plan.Diff)
+}
+
+// The target job is the job file when one is given, otherwise the job running in the target cluster.
+func promoteTargetJob(job_id string, jobFile string, jobFileOptions *JobFileOptions) *nomadapi.Job {
+	if jobFile == "" {
+		targetJob, _, err := utils.GetNomadClient().Jobs().Info(job_id, nil)
+		if err != nil {
+			fmt.Printf("Unable to get job %s from nomad of profile %s, Error: %s \n", job_id, viper.GetString("active"), err)
+			exitWith(ERR_NOMAD_API)
+		}
+		return targetJob
+	}
+
+	_, parsedFile := parseNomadJobFile(jobFile, jobFileOptions)
+	if jobID(parsedFile) != job_id {
+		fmt.Printf("Job file %s is for job %s, not %s \n", jobFile, jobID(parsedFile), job_id)
+		exitWith(ERR_PROMOTE)
+	}
+
+	return parsedFile
+}
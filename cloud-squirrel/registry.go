@@ -0,0 +1,226 @@
+// Checks that the docker images of a job exist, using the Docker Registry HTTP API v2.
+// The nexus registry (repoPullName) is accessed with the nexus-docker-reg secret from vault.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	nomadapi "github.com/hashicorp/nomad/api"
+
+	"./utils"
+)
+
+const (
+	ERR_IMAGE_NOT_FOUND = 29
+
+	DOCKER_HUB_REGISTRY = "registry-1.docker.io"
+)
+
+var registryManifestTypes = []string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+}
+
+var bearerChallengeRegexp = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+type ImageReference struct {
+	Registry   string
+	Repository string
+	Reference  string
+}
+
+type RegistryClient struct {
+	httpClient *http.Client
+	// basic auth password per registry host, fetched from vault when first needed
+	passwords map[string]string
+}
+
+func NewRegistryClient() *RegistryClient {
+	return &RegistryClient{
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		passwords:  make(map[string]string),
+	}
+}
+
+// Refuses the job if any of its docker images or tags doesn't exist in its registry.
+func checkJobImages(parsedFile *nomadapi.Job) {
+	registryClient := NewRegistryClient()
+	missing := make([]string, 0)
+
+	for _, taskImage := range dockerTaskImages(parsedFile) {
+		if strings.Contains(taskImage.Image, "${") {
+			fmt.Printf("Skipping registry check of interpolated image %s of task %s \n", taskImage.Image, taskImage.Task)
+			continue
+		}
+
+		exists, err := registryClient.ImageExists(parseImageReference(taskImage.Image))
+		if err != nil {
+			missing = append(missing, fmt.Sprintf("%s (task %s): %s", taskImage.Image, taskImage.Task, err))
+			continue
+		}
+		if !exists {
+			missing = append(missing, fmt.Sprintf("%s (task %s): not found", taskImage.Image, taskImage.Task))
+		}
+	}
+
+	if len(missing) > 0 {
+		fmt.Printf("Docker images of job %s could not be verified, will not start job: \n  %s \n", jobID(parsedFile), strings.Join(missing, "\n  "))
+		exitWith(ERR_IMAGE_NOT_FOUND)
+	}
+}
+
+// artifact-repo:6070/rcs/envoy:1.0.6 -> {artifact-repo:6070 rcs/envoy 1.0.6}, consul -> {registry-1.docker.io library/consul latest}
+func parseImageReference(image string) ImageReference {
+	registry := imageRegistry(image)
+	name := image
+	if registry != "" {
+		name = strings.TrimPrefix(image, registry+"/")
+	} else {
+		registry = DOCKER_HUB_REGISTRY
+		if !strings.Contains(name, "/") {
+			name = "library/" + name
+		}
+	}
+
+	reference := "latest"
+	if i := strings.Index(name, "@"); i >= 0 {
+		reference = name[i+1:]
+		name = name[:i]
+	} else if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		reference = name[i+1:]
+		name = name[:i]
+	}
+
+	return ImageReference{Registry: registry, Repository: name, Reference: reference}
+}
+
+func (c *RegistryClient) ImageExists(image ImageReference) (bool, error) {
+	resp, err := c.headManifest("https", image, "")
+	if err != nil && strings.Contains(err.Error(), "server gave HTTP response to HTTPS client") {
+		resp, err = c.headManifest("http", image, "")
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		scheme := resp.Request.URL.Scheme
+		token, err := c.bearerToken(resp.Header.Get("WWW-Authenticate"), image)
+		if err != nil {
+			return false, err
+		}
+		resp, err = c.headManifest(scheme, image, token)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected registry response: %s", resp.Status)
+	}
+}
+
+func (c *RegistryClient) headManifest(scheme string, image ImageReference, token string) (*http.Response, error) {
+	manifestURL := fmt.Sprintf("%s://%s/v2/%s/manifests/%s", scheme, image.Registry, image.Repository, image.Reference)
+
+	req, err := http.NewRequest(http.MethodHead, manifestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", strings.Join(registryManifestTypes, ", "))
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if password := c.password(image.Registry); password != "" {
+		req.SetBasicAuth("docker", password)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	return resp, nil
+}
+
+// Gets a pull token for registries that use token authentication (docker hub and other v2 registries).
+func (c *RegistryClient) bearerToken(challenge string, image ImageReference) (string, error) {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return "", fmt.Errorf("registry %s refused the credentials", image.Registry)
+	}
+
+	params := make(map[string]string)
+	for _, match := range bearerChallengeRegexp.FindAllStringSubmatch(challenge, -1) {
+		params[match[1]] = match[2]
+	}
+
+	tokenURL, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("malformed authentication challenge from registry %s: %s", image.Registry, challenge)
+	}
+	query := tokenURL.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	query.Set("scope", fmt.Sprintf("repository:%s:pull", image.Repository))
+	tokenURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if password := c.password(image.Registry); password != "" {
+		req.SetBasicAuth("docker", password)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unable to get a pull token from %s: %s", tokenURL.Host, resp.Status)
+	}
+
+	var tokenResponse struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResponse); err != nil {
+		return "", err
+	}
+	if tokenResponse.Token != "" {
+		return tokenResponse.Token, nil
+	}
+
+	return tokenResponse.AccessToken, nil
+}
+
+// Only our own nexus registry gets credentials.
+func (c *RegistryClient) password(registry string) string {
+	if registry != utils.GetConfigString("repoPullName") && registry != utils.GetConfigString("repoPushName") {
+		return ""
+	}
+
+	if _, ok := c.passwords[registry]; !ok {
+		c.passwords[registry] = utils.GetDataFromVault(DOCKER_REGISTRY_KEY)
+	}
+
+	return c.passwords[registry]
+}
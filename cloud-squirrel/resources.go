@@ -0,0 +1,197 @@
+// Default resources for tasks without a resources block, and right-sizing recommendations
+// from the resource usage of the running allocations (cs rightsize).
+//
+// The defaults are set per node class of the profile in cs.properties:
+//
+//	prod.default_resources.prod.cpu=500
+//	prod.default_resources.prod.memory=512
+//
+// Without them nomad's defaults are used.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/viper"
+
+	nomadapi "github.com/hashicorp/nomad/api"
+
+	"./utils"
+)
+
+const (
+	ERR_RIGHTSIZE = 38
+
+	NOMAD_DEFAULT_CPU    = 100
+	NOMAD_DEFAULT_MEMORY = 300
+
+	RIGHTSIZE_MIN_CPU    = 20
+	RIGHTSIZE_MIN_MEMORY = 32
+)
+
+func defaultResource(nodeClass string, quota_key string, nomadDefault int) int {
+	value := viper.GetInt(viper.GetString("active") + ".default_resources." + nodeClass + "." + quota_key)
+	if value <= 0 {
+		return nomadDefault
+	}
+
+	return value
+}
+
+// Fills in the cpu and memory of the tasks that don't set them with the defaults of the job's node class.
+func applyDefaultResources(parsedFile *nomadapi.Job) {
+	nodeClass := utils.GetConstraintValue(parsedFile.Constraints, "${node.class}")
+	cpu := defaultResource(nodeClass, "cpu", NOMAD_DEFAULT_CPU)
+	memory := defaultResource(nodeClass, "memory", NOMAD_DEFAULT_MEMORY)
+
+	for _, taskGroup := range parsedFile.TaskGroups {
+		for _, task := range taskGroup.Tasks {
+			if task.Resources == nil {
+				task.Resources = &nomadapi.Resources{}
+			}
+			if task.Resources.CPU == nil {
+				fmt.Fprintf(os.Stderr, "Task %s has no cpu, using the default of node class %s: %d \n", task.Name, nodeClass, cpu)
+				task.Resources.CPU = &cpu
+			}
+			if task.Resources.MemoryMB == nil {
+				fmt.Fprintf(os.Stderr, "Task %s has no memory, using the default of node class %s: %d \n", task.Name, nodeClass, memory)
+				task.Resources.MemoryMB = &memory
+			}
+		}
+	}
+}
+
+type TaskUsage struct {
+	Group           string
+	Task            string
+	Count           int
+	RequestedCPU    int
+	RequestedMemory int
+	PeakCPU         float64
+	PeakMemory      uint64
+	Samples         int
+}
+
+// Samples the resource usage of the running allocations of the job every interval for the window,
+// and prints the cpu/memory each task needs with the headroom (in percent) on top of its peak usage.
+func rightsizeJob(nomadClient *nomadapi.Client, job_id string, window time.Duration, interval time.Duration, headroom int) {
+	runningJob, _, err := nomadClient.Jobs().Info(job_id, nil)
+	if err != nil {
+		fmt.Printf("Unable to get job %s from nomad, Error: %s \n", job_id, err)
+		exitWith(ERR_NOMAD_API)
+	}
+	runningJob.Canonicalize()
+
+	usages := make(map[string]*TaskUsage)
+	order := make([]string, 0)
+	for _, taskGroup := range runningJob.TaskGroups {
+		for _, task := range taskGroup.Tasks {
+			key := *taskGroup.Name + "." + task.Name
+			usages[key] = &TaskUsage{
+				Group:           *taskGroup.Name,
+				Task:            task.Name,
+				Count:           *taskGroup.Count,
+				RequestedCPU:    *task.Resources.CPU,
+				RequestedMemory: *task.Resources.MemoryMB,
+			}
+			order = append(order, key)
+		}
+	}
+
+	allocs, _, err := nomadClient.Jobs().Allocations(job_id, false, nil)
+	if err != nil {
+		fmt.Printf("Unable to get the allocations of job %s, Error: %s \n", job_id, err)
+		exitWith(ERR_NOMAD_API)
+	}
+
+	running := make([]*nomadapi.AllocationListStub, 0)
+	for _, alloc := range allocs {
+		if alloc.ClientStatus == "running" {
+			running = append(running, alloc)
+		}
+	}
+	if len(running) == 0 {
+		fmt.Printf("Job %s has no running allocations \n", job_id)
+		exitWith(ERR_RIGHTSIZE)
+	}
+
+	fmt.Printf("Sampling %d allocations of job %s every %s for %s \n", len(running), job_id, interval, window)
+	deadline := time.Now().Add(window)
+	for {
+		for _, alloc := range running {
+			stats, err := nomadClient.Allocations().Stats(&nomadapi.Allocation{ID: alloc.ID}, nil)
+			if err != nil {
+				fmt.Printf("Unable to get the resource usage of allocation %s, Error: %s \n", shortID(alloc.ID), err)
+				continue
+			}
+			for task, taskStats := range stats.Tasks {
+				usage, ok := usages[alloc.TaskGroup+"."+task]
+				if !ok || taskStats.ResourceUsage == nil {
+					continue
+				}
+				sampleTaskUsage(usage, taskStats.ResourceUsage)
+			}
+		}
+
+		if time.Now().Add(interval).After(deadline) {
+			break
+		}
+		time.Sleep(interval)
+	}
+
+	printRightsizing(runningJob, usages, order, headroom)
+}
+
+func sampleTaskUsage(usage *TaskUsage, resourceUsage *nomadapi.ResourceUsage) {
+	if resourceUsage.CpuStats != nil {
+		usage.PeakCPU = math.Max(usage.PeakCPU, resourceUsage.CpuStats.TotalTicks)
+	}
+	if resourceUsage.MemoryStats != nil {
+		memory := resourceUsage.MemoryStats.RSS
+		if memory == 0 {
+			memory = resourceUsage.MemoryStats.Usage
+		}
+		if memory > usage.PeakMemory {
+			usage.PeakMemory = memory
+		}
+	}
+	usage.Samples++
+}
+
+func recommendedAmount(peak float64, headroom int, minimum int) int {
+	return int(math.Max(math.Ceil(peak*(1+float64(headroom)/100)), float64(minimum)))
+}
+
+func printRightsizing(runningJob *nomadapi.Job, usages map[string]*TaskUsage, order []string, headroom int) {
+	freedCPU := 0
+	freedMemory := 0
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(writer, "task\tcount\tcpu requested\tcpu peak\tcpu recommended\tmemory requested\tmemory peak\tmemory recommended\n")
+	for _, key := range order {
+		usage := usages[key]
+		if usage.Samples == 0 {
+			fmt.Fprintf(writer, "%s\t%d\t%d\t-\t-\t%d\t-\t-\n", key, usage.Count, usage.RequestedCPU, usage.RequestedMemory)
+			continue
+		}
+
+		peakMemoryMB := float64(usage.PeakMemory) / (1024 * 1024)
+		cpu := recommendedAmount(usage.PeakCPU, headroom, RIGHTSIZE_MIN_CPU)
+		memory := recommendedAmount(peakMemoryMB, headroom, RIGHTSIZE_MIN_MEMORY)
+		freedCPU += (usage.RequestedCPU - cpu) * usage.Count
+		freedMemory += (usage.RequestedMemory - memory) * usage.Count
+
+		fmt.Fprintf(writer, "%s\t%d\t%d\t%.0f\t%d\t%d\t%.0f\t%d\n", key, usage.Count,
+			usage.RequestedCPU, usage.PeakCPU, cpu, usage.RequestedMemory, peakMemoryMB, memory)
+	}
+	writer.Flush()
+
+	fmt.Printf("\nWith %d%% headroom the recommended resources would free: \n", headroom)
+	fmt.Printf("  %s: %d MHz \n", utils.BuildNomadQuotaKey("cpu", runningJob.Constraints), freedCPU)
+	fmt.Printf("  %s: %d MB \n", utils.BuildNomadQuotaKey("memory", runningJob.Constraints), freedMemory)
+}
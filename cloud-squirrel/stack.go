@@ -0,0 +1,288 @@
+// Multi-job deploy manifests (cs apply -f stack.yaml).
+// The jobs of a stack are checked against the quotas together and deployed in dependency order.
+//
+// Example stack.yaml:
+//
+//	jobs:
+//	  - name: consul-server
+//	    file: infrastructure/consul-server.nomad
+//	  - name: vault
+//	    file: infrastructure/vault.nomad
+//	    depends_on: [consul-server]
+//	  - name: scoring
+//	    file: apps/scoring.nomad
+//	    artifact_id: rcs/scoring:1.0.4
+//	    env: uat
+//	    vars:
+//	      log_level: info
+//	    depends_on: [vault]
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	consulapi "github.com/hashicorp/consul/api"
+	nomadapi "github.com/hashicorp/nomad/api"
+	yaml "gopkg.in/yaml.v2"
+
+	"./utils"
+)
+
+const (
+	ERR_STACK        = 27
+	ERR_STACK_DEPLOY = 28
+
+	STACK_HEALTH_POLL_INTERVAL = 5 * time.Second
+)
+
+type Stack struct {
+	Jobs []*StackJob `yaml:"jobs"`
+}
+
+type StackJob struct {
+	Name       string            `yaml:"name"`
+	File       string            `yaml:"file"`
+	ArtifactID string            `yaml:"artifact_id"`
+	Env        string            `yaml:"env"`
+	Vars       map[string]string `yaml:"vars"`
+	DependsOn  []string          `yaml:"depends_on"`
+
+	parsedFile *nomadapi.Job
+	fileHash   string
+	source     string
+	result     string
+}
+
+func readStack(stackFile string) *Stack {
+	content, err := ioutil.ReadFile(stackFile)
+	if err != nil {
+		fmt.Printf("Unable to open stack file: %s, Error: %s \n", stackFile, err)
+		exitWith(ERR_STACK)
+	}
+
+	var stack Stack
+	if err := yaml.UnmarshalStrict(content, &stack); err != nil {
+		fmt.Printf("Unable to parse stack file: %s, Error: %s \n", stackFile, err)
+		exitWith(ERR_STACK)
+	}
+
+	// job files are relative to the stack file
+	stackDir := filepath.Dir(stackFile)
+	for _, stackJob := range stack.Jobs {
+		if stackJob.Name == "" || stackJob.File == "" {
+			fmt.Printf("Every job in stack file %s needs a name and a file \n", stackFile)
+			exitWith(ERR_STACK)
+		}
+		if !filepath.IsAbs(stackJob.File) && !isRemoteJobSource(stackJob.File) {
+			stackJob.File = filepath.Join(stackDir, stackJob.File)
+		}
+	}
+
+	return &stack
+}
+
+// Orders the jobs so that every job comes after the jobs it depends on.
+func sortStackJobs(stackJobs []*StackJob) ([]*StackJob, error) {
+	byName := make(map[string]*StackJob)
+	for _, stackJob := range stackJobs {
+		if _, ok := byName[stackJob.Name]; ok {
+			return nil, fmt.Errorf("job %q is listed more than once", stackJob.Name)
+		}
+		byName[stackJob.Name] = stackJob
+	}
+
+	pending := make(map[string]int)
+	dependents := make(map[string][]string)
+	for _, stackJob := range stackJobs {
+		for _, dependency := range stackJob.DependsOn {
+			if _, ok := byName[dependency]; !ok {
+				return nil, fmt.Errorf("job %q depends on %q which is not in the stack", stackJob.Name, dependency)
+			}
+			pending[stackJob.Name]++
+			dependents[dependency] = append(dependents[dependency], stackJob.Name)
+		}
+	}
+
+	// the order of the stack file is kept between jobs that don't depend on each other
+	sorted := make([]*StackJob, 0, len(stackJobs))
+	ready := make([]*StackJob, 0)
+	for _, stackJob := range stackJobs {
+		if pending[stackJob.Name] == 0 {
+			ready = append(ready, stackJob)
+		}
+	}
+
+	for len(ready) > 0 {
+		stackJob := ready[0]
+		ready = ready[1:]
+		sorted = append(sorted, stackJob)
+
+		for _, dependent := range dependents[stackJob.Name] {
+			pending[dependent]--
+			if pending[dependent] == 0 {
+				ready = append(ready, byName[dependent])
+			}
+		}
+	}
+
+	if len(sorted) != len(stackJobs) {
+		cyclic := make([]string, 0)
+		for name, count := range pending {
+			if count > 0 {
+				cyclic = append(cyclic, name)
+			}
+		}
+		sort.Strings(cyclic)
+		return nil, fmt.Errorf("dependency cycle between jobs: %s", strings.Join(cyclic, ", "))
+	}
+
+	return sorted, nil
+}
+
+func loadStackJob(stackJob *StackJob, isValidNodeClass map[string]bool) {
+	jobFileOptions := JobFileOptions{Env: stackJob.Env}
+	for k, v := range stackJob.Vars {
+		jobFileOptions.Vars = append(jobFileOptions.Vars, k+"="+v)
+	}
+
+	_, parsedFile, fileHash, source := readNomadJobFile(stackJob.File, &jobFileOptions)
+
+	if stackJob.ArtifactID != "" {
+		artifactIds, err := parseArtifactIds(stackJob.ArtifactID, "")
+		if err == nil {
+			err = applyArtifactIds(parsedFile, artifactIds)
+		}
+		if err != nil {
+			fmt.Printf("Unable to apply artifact id of job %s: %s, Error: %s \n", stackJob.Name, stackJob.ArtifactID, err)
+			exitWith(ERR_ARTIFACT_ID)
+		}
+	}
+
+	checkJobConstraints(parsedFile, isValidNodeClass)
+	checkJobEnvironment(parsedFile)
+	checkJobImages(parsedFile)
+	checkStaticPorts(parsedFile)
+	checkJobApproval(utils.GetConsulClient(), parsedFile)
+
+	stackJob.parsedFile = parsedFile
+	stackJob.fileHash = fileHash
+	stackJob.source = source
+}
+
+// Checks the quota change of the whole stack up front: the resources of the stack's jobs
+// minus the resources of the versions of those jobs that are already running.
+func checkStackQuota(stackJobs []*StackJob, nomadClient *nomadapi.Client, consulClient *consulapi.Client) {
+	deltas := make(map[string]int)
+	quotaKeys := make(map[string]string)
+
+	for _, stackJob := range stackJobs {
+		runningJob, _, err := nomadClient.Jobs().Info(jobID(stackJob.parsedFile), nil)
+		if err != nil || runningJob.Status == nil || (*runningJob.Status != "running" && *runningJob.Status != "pending") {
+			runningJob = nil
+		}
+
+		for _, quota_key := range []string{"cpu", "memory"} {
+			key := utils.BuildNomadQuotaKey(quota_key, stackJob.parsedFile.Constraints)
+			deltas[key] += jobResourceAmount(quota_key, stackJob.parsedFile)
+			quotaKeys[key] = quota_key
+
+			if runningJob != nil {
+				runningKey := utils.BuildNomadQuotaKey(quota_key, runningJob.Constraints)
+				deltas[runningKey] -= jobResourceAmount(quota_key, runningJob)
+				quotaKeys[runningKey] = quota_key
+			}
+		}
+	}
+
+	for key, delta := range deltas {
+		checkQuotaKeyDelta(quotaKeys[key], key, delta, consulClient)
+	}
+}
+
+// Deploys the jobs in order and stops at the first failure. Returns the exit code for the command.
+func deployStack(cmd *cobra.Command, stackJobs []*StackJob, nomadClient *nomadapi.Client, consulClient *consulapi.Client,
+	deployOptions *DeployOptions, lockWait time.Duration, breakGlassReason string, awsEnv string) int {
+	byName := make(map[string]*StackJob)
+	for _, stackJob := range stackJobs {
+		byName[stackJob.Name] = stackJob
+		stackJob.result = "skipped"
+	}
+
+	for _, stackJob := range stackJobs {
+		for _, dependency := range stackJob.DependsOn {
+			if dryRun {
+				// the dependencies are not deployed, so there is nothing to wait for
+				break
+			}
+			fmt.Printf("Waiting for the services of %s to be healthy before deploying %s \n", dependency, stackJob.Name)
+			if err := waitForServicesHealthy(jobServices(byName[dependency].parsedFile), time.Now().Add(deployOptions.Timeout)); err != nil {
+				fmt.Printf("Dependency %s of %s is not healthy: %s \n", dependency, stackJob.Name, err)
+				stackJob.result = "failed: dependency " + dependency + " not healthy"
+				return ERR_STACK_DEPLOY
+			}
+		}
+
+		fmt.Printf("Deploying %s (%s) \n", stackJob.Name, stackJob.File)
+		startAudit(cmd, []string{stackJob.File})
+		auditJobFile(stackJob.fileHash, stackJob.source)
+		auditJob(stackJob.parsedFile)
+		// again, a freeze can start while the stack waits for dependencies, and a broken freeze goes to the audit record of the job
+		checkDeployFreeze(consulClient, stackJob.parsedFile, breakGlassReason)
+
+		// the same deploy lock as cs run, held for the submission and the ALB sync of the job
+		if err := tryAcquireDeployLock(consulClient, jobID(stackJob.parsedFile), lockWait); err != nil {
+			fmt.Printf("%s \n", err)
+			finishAudit(ERR_DEPLOY_LOCK)
+			stackJob.result = fmt.Sprintf("failed (exit code %d)", ERR_DEPLOY_LOCK)
+			return ERR_DEPLOY_LOCK
+		}
+
+		_, exitCode := submitNomadJob(nomadClient, stackJob.parsedFile, deployOptions)
+		if exitCode != EXIT_SUCCESS {
+			releaseDeployLock()
+			finishAudit(exitCode)
+			stackJob.result = fmt.Sprintf("failed (exit code %d)", exitCode)
+			return exitCode
+		}
+
+		updateTargetGroup(AWS_KEY_ID, AWS_ACCESS_KEY, awsEnv, jobServices(stackJob.parsedFile))
+		releaseDeployLock()
+		finishAudit(exitCode)
+		stackJob.result = "deployed"
+	}
+
+	return EXIT_SUCCESS
+}
+
+// Waits until every service has at least one instance passing its consul health checks.
+func waitForServicesHealthy(services []Service, deadline time.Time) error {
+	for _, service := range services {
+		for {
+			serviceAddresses, _, _ := utils.GetServiceAddresses(service.Name, nil, nil)
+			if len(serviceAddresses) > 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("no healthy instances of service %s", service.Name)
+			}
+			time.Sleep(STACK_HEALTH_POLL_INTERVAL)
+		}
+	}
+
+	return nil
+}
+
+func printStackSummary(stackJobs []*StackJob) {
+	fmt.Printf("\nStack summary: \n")
+	for _, stackJob := range stackJobs {
+		fmt.Printf("  %-30s %s \n", stackJob.Name, stackJob.result)
+	}
+}
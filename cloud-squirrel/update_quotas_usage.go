@@ -4,8 +4,10 @@
 package main
 
 import (
+	"flag"
 	"io/ioutil"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -34,6 +36,11 @@ const (
 )
 
 func main() {
+	// -report prints the recalculated usage next to the stored usage and the limit of every quota key, without writing anything,
+	// to find the limits to raise before the count-aware usage is rolled out
+	report := flag.Bool("report", false, "print the recalculated quota usage next to the stored usage and limit, don't update consul")
+	flag.Parse()
+
 	logger.Init(ioutil.Discard, os.Stdout, os.Stdout, os.Stderr)
 	logger.Info.Printf("Starting... \n")
 
@@ -59,10 +66,10 @@ func main() {
 		os.Exit(ERR_CONSUL_CLIENT)
 	}
 
-	update_quota_usage(host, consulClient)
+	update_quota_usage(host, consulClient, *report)
 }
 
-func update_quota_usage(host string, consulClient *consul.Client) {
+func update_quota_usage(host string, consulClient *consul.Client, report bool) {
 	logger.Info.Printf("Connecting to Nomad and getting jobs... \n")
 
 	client, cerr := api.NewClient(&api.Config{Address: host, TLSConfig: &api.TLSConfig{}})
@@ -80,7 +87,7 @@ func update_quota_usage(host string, consulClient *consul.Client) {
 	}
 
 	quota_usage_map := make(map[string]int)
-	resetQuotaUsage(consulClient)
+	parent_constraints := make(map[string][]*api.Constraint)
 
 	for _, job := range jobList {
 		logger.Info.Printf("processing job id=%s \n", job.ID)
@@ -96,20 +103,106 @@ func update_quota_usage(host string, consulClient *consul.Client) {
 			continue
 		}
 
+		// periodic and parameterized jobs don't run themselves, their child jobs do
+		if value.IsPeriodic() || value.IsParameterized() {
+			logger.Info.Printf("Excluding job id=%s from quota calculations. Periodic or parameterized parent job \n", job.ID)
+			continue
+		}
+
+		constraints := value.Constraints
+		if value.ParentID != nil && *value.ParentID != "" {
+			constraints = getParentConstraints(client, *value.ParentID, value.Constraints, parent_constraints)
+		}
+
+		// every instance of a group uses the resources of its tasks, cs run, scale and dispatch check the quotas the same way
 		for i := 0; i < len(value.TaskGroups); i++ {
-			for j := 0; j < len(value.TaskGroups[i].Tasks); j++ {
-				quota_key := "cpu"
-				calculateQuotaUsage(quota_key, utils.BuildNomadQuotaKey(quota_key, value.Constraints), *value.TaskGroups[i].Tasks[j].Resources.CPU, &quota_usage_map)
+			count := 1
+			if value.TaskGroups[i].Count != nil {
+				count = *value.TaskGroups[i].Count
+			}
 
-				quota_key = "memory"
-				calculateQuotaUsage(quota_key, utils.BuildNomadQuotaKey(quota_key, value.Constraints), *value.TaskGroups[i].Tasks[j].Resources.MemoryMB, &quota_usage_map)
+			for j := 0; j < len(value.TaskGroups[i].Tasks); j++ {
+				resources := value.TaskGroups[i].Tasks[j].Resources
+				if resources == nil {
+					continue
+				}
+
+				if resources.CPU != nil {
+					quota_key := "cpu"
+					calculateQuotaUsage(quota_key, utils.BuildNomadQuotaKey(quota_key, constraints), *resources.CPU*count, &quota_usage_map)
+				}
+				if resources.MemoryMB != nil {
+					quota_key := "memory"
+					calculateQuotaUsage(quota_key, utils.BuildNomadQuotaKey(quota_key, constraints), *resources.MemoryMB*count, &quota_usage_map)
+				}
 			}
 		}
 	}
 
+	if report {
+		printQuotaReport(quota_usage_map, consulClient)
+		return
+	}
+
+	resetQuotaUsage(consulClient)
 	updateQuotaUsage(&quota_usage_map, consulClient)
 }
 
+func printQuotaReport(quota_usage_map map[string]int, consulClient *consul.Client) {
+	keys := make([]string, 0, len(quota_usage_map))
+	for k := range quota_usage_map {
+		if strings.Contains(k, "---") { // skipping keys that dont have all the needed info
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fmt.Printf("%-50s %10s %10s %10s \n", "quota key", "usage", "stored", "limit")
+	for _, k := range keys {
+		stored := readQuotaValue(consulClient, "quotas/usage/"+k)
+		limit := readQuotaValue(consulClient, "quotas/limit/"+k)
+
+		exceeded := ""
+		if limit != "" {
+			if limitValue, err := strconv.Atoi(limit); err == nil && quota_usage_map[k] > limitValue {
+				exceeded = "over the limit"
+			}
+		}
+		fmt.Printf("%-50s %10d %10s %10s %s \n", k, quota_usage_map[k], stored, limit, exceeded)
+	}
+}
+
+func readQuotaValue(consulClient *consul.Client, key string) string {
+	kvpair, _, err := consulClient.KV().Get(key, nil)
+	if err != nil {
+		logger.Error.Printf("Cannot read key %s from consul: %s \n", key, err)
+		return ""
+	}
+	if kvpair == nil {
+		return ""
+	}
+
+	return string(kvpair.Value)
+}
+
+// Child jobs of dispatched and periodic jobs are accounted to the env--group of their parent job.
+func getParentConstraints(client *api.Client, parent_id string, child_constraints []*api.Constraint, parent_constraints map[string][]*api.Constraint) []*api.Constraint {
+	if constraints, ok := parent_constraints[parent_id]; ok {
+		return constraints
+	}
+
+	parent, _, err := client.Jobs().Info(parent_id, &api.QueryOptions{})
+	if err != nil {
+		logger.Error.Printf("Cannot get parent job id=%s from Nomad, using the constraints of the child job: %v \n", parent_id, err.Error())
+		return child_constraints
+	}
+
+	parent_constraints[parent_id] = parent.Constraints
+
+	return parent.Constraints
+}
+
 func calculateQuotaUsage(quota_key string, quota_usage_key string, quota_usage_value int, quota_usage_map *map[string]int) {
 	usage_map := *quota_usage_map
 
@@ -5,7 +5,6 @@ package utils
 
 import (
 	"fmt"
-	"log"
 	"os"
 	"regexp"
 
@@ -51,12 +50,20 @@ const (
 	NOMAD_QUOTA_KEY_SEPARATOR             = "--"
 	EXIT_SUCCESS                          = 0
 	ERR_CERT_UPLOAD                       = 10
+	ERR_NOMAD_CLIENT                      = 11
 )
 
+// The utilities exit through Exit, cs replaces it to write the audit record of the failed command first.
+var Exit = os.Exit
+
 func GetConfigString(config_key string) string {
 	active_config_profile := viper.GetString("active")
 
-	return viper.GetString(active_config_profile + "." + config_key)
+	return GetProfileConfigString(active_config_profile, config_key)
+}
+
+func GetProfileConfigString(config_profile string, config_key string) string {
+	return viper.GetString(config_profile + "." + config_key)
 }
 
 func GetVaultClient() vaultAPI.Client {
@@ -66,8 +73,8 @@ func GetVaultClient() vaultAPI.Client {
 	var err error
 	vClient, err := vaultAPI.NewClient(vaultCFG)
 	if err != nil {
-		log.Fatal(err)
-		os.Exit(13)
+		fmt.Printf("Unable to create the vault client, Error: %s \n", err)
+		Exit(13)
 	}
 
 	vClient.SetToken(GetDataFromConsul(VAULT_ACCESS_TOKEN_KEY_NAME_IN_CONSUL))
@@ -86,23 +93,43 @@ func GetConsulClient() *consulAPI.Client {
 	consulClient, err := consulAPI.NewClient(config)
 	if err != nil {
 		fmt.Printf("Unable to create client(%v): %v", consulAddress, err)
-		os.Exit(1)
+		Exit(1)
 	}
 
 	return consulClient
 }
 
+func GetNomadClient() *nomadapi.Client {
+	return GetProfileNomadClient(viper.GetString("active"))
+}
+
+func GetProfileNomadClient(config_profile string) *nomadapi.Client {
+	nomadAddress := GetProfileConfigString(config_profile, "nomad_server")
+	if nomadAddress == "" {
+		fmt.Printf("Missing nomad_server in config profile %s \n", config_profile)
+		Exit(ERR_NOMAD_CLIENT)
+	}
+
+	nomadClient, err := nomadapi.NewClient(&nomadapi.Config{Address: nomadAddress, TLSConfig: &nomadapi.TLSConfig{}})
+	if err != nil {
+		fmt.Printf("Unable to create nomad client(%v): %v", nomadAddress, err)
+		Exit(ERR_NOMAD_CLIENT)
+	}
+
+	return nomadClient
+}
+
 func GetDataFromConsul(dataName string) string {
 	client := GetConsulClient()
 	kvp, _, err := client.KV().Get(CONSUL_INFRASTRUCTURE_PATH+dataName, nil)
 	if err != nil {
 		fmt.Println(err)
-		os.Exit(ERR_CONSUL_CLIENT)
+		Exit(ERR_CONSUL_CLIENT)
 	}
 
 	if kvp == nil {
 		fmt.Printf("unable to find data in consul for dataName=%s, path=%s \n", dataName, CONSUL_INFRASTRUCTURE_PATH)
-		os.Exit(ERR_NOT_FOUND)
+		Exit(ERR_NOT_FOUND)
 	}
 
 	return string(kvp.Value)
@@ -124,7 +151,7 @@ func SaveDataInVault(dataName string, dataValue string) {
 	_, err := vault.Logical().Write(pathArg, dataMap)
 	if err != nil {
 		fmt.Printf("unable to store data(%s) in vault , exiting. Error: %v. Data:%v  \n", dataName, err, dataMap)
-		os.Exit(ERR_VAULT_CANNOT_WRITE)
+		Exit(ERR_VAULT_CANNOT_WRITE)
 	}
 }
 
@@ -136,21 +163,21 @@ func GetDataFromVault(dataName string) string {
 	secret, err := vault.Logical().Read(pathArg)
 	if err != nil {
 		fmt.Printf("error reading path %s. Error: %s  \n", pathArg, err)
-		os.Exit(ERR_VAULT_READ)
+		Exit(ERR_VAULT_READ)
 	}
 	if secret == nil {
 		fmt.Printf("no value found at %s \n", pathArg)
-		os.Exit(ERR_VAULT_READ)
+		Exit(ERR_VAULT_READ)
 	}
 	if secret.Data == nil {
 		fmt.Printf("\"data\" not found in wrapping response, secret=%v", secret)
-		os.Exit(ERR_VAULT_READ)
+		Exit(ERR_VAULT_READ)
 	}
 
 	_, ok := secret.Data["data"]
 	if !ok {
 		fmt.Printf("\"data\" not found in wrapping response secret=%v", secret)
-		os.Exit(ERR_NOT_FOUND)
+		Exit(ERR_NOT_FOUND)
 	}
 
 	secretDataMap := secret.Data["data"]
@@ -158,7 +185,7 @@ func GetDataFromVault(dataName string) string {
 	md, ok := secretDataMap.(map[string]interface{})
 	if !ok {
 		fmt.Printf("unable to find value for %s, exiting  \n", dataName)
-		os.Exit(ERR_NOT_FOUND)
+		Exit(ERR_NOT_FOUND)
 	}
 
 	secretValue := md[dataName]
@@ -195,20 +222,20 @@ func ValidateConstraint(constraints []*nomadapi.Constraint, constraintName strin
 			constraintIsPresent = true
 			if constraint.RTarget == "" {
 				fmt.Printf(errorMessage, constraintName)
-				os.Exit(ERR_NOT_FOUND)
+				Exit(ERR_NOT_FOUND)
 			}
 		}
 	}
 
 	if !constraintIsPresent {
 		fmt.Printf(errorMessage, constraintName)
-		os.Exit(ERR_NOT_FOUND)
+		Exit(ERR_NOT_FOUND)
 	}
 }
 
 func ExitErrorf(msg string, args ...interface{}) {
 	fmt.Fprintf(os.Stderr, msg+"\n", args...)
-	os.Exit(1)
+	Exit(1)
 }
 
 func AwsCredentialsCleanup(toClean string) string {
@@ -245,12 +272,12 @@ func GetKVPairsFromConsulWithPath(path string) consulAPI.KVPairs {
 	kvps, _, err := client.KV().List(path, nil)
 	if err != nil {
 		fmt.Println(err)
-		os.Exit(ERR_CONSUL_CLIENT)
+		Exit(ERR_CONSUL_CLIENT)
 	}
 
 	if kvps == nil {
 		fmt.Printf("unable to find data in consul for path=%s \n", path)
-		os.Exit(ERR_NOT_FOUND)
+		Exit(ERR_NOT_FOUND)
 	}
 
 	return kvps
@@ -266,7 +293,7 @@ func GetServiceAddresses(serviceName string, tags []string, q *consulAPI.QueryOp
 	lastIndex := metadata.LastIndex
 	if err != nil {
 		fmt.Println(err)
-		os.Exit(ERR_CONSUL_CLIENT)
+		Exit(ERR_CONSUL_CLIENT)
 	}
 	lengthOfServiceAddress := len(service)
 	serviceAddresses := make([]ServiceAddress, 0)